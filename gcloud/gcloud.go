@@ -2,8 +2,15 @@ package gcloud
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
 	"os/exec"
+	"strings"
+
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/retry"
 )
 
 type GCloud struct {
@@ -15,6 +22,19 @@ type GCloud struct {
 	SSLCert *SSLCert
 	Proxy *Proxy
 	ForwardRule *ForwardRule
+	StorageBucket *StorageBucket
+	KMS *KMS
+	Auth *Auth
+	// stamped on every compute resource created, which take no labels
+	Description string
+	// identity every command runs as, ambient gcloud credentials when unset
+	Account string
+	ImpersonateServiceAccount string
+	CredentialsFile string
+	// retries transient failures of every command, nil runs each command once
+	Retry *retry.Policy
+	// cancels running commands and their retries, never cancelled when unset
+	Context context.Context
 }
 
 func Init(project, bucket string) *GCloud {
@@ -29,13 +49,55 @@ func Init(project, bucket string) *GCloud {
 	gc.SSLCert = &SSLCert{g: gc}
 	gc.Proxy = &Proxy{g: gc}
 	gc.ForwardRule = &ForwardRule{g: gc}
+	gc.StorageBucket = &StorageBucket{g: gc}
+	gc.KMS = &KMS{g: gc}
+	gc.Auth = &Auth{g: gc}
 
 	return gc
 }
 
 func (g *GCloud) Exec(args []string) (string, error) {
+	n := len(args)
+	if n > 3 {
+		n = 3
+	}
+
+	ctx := g.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// a create that timed out may still have gone through, so a retry that finds
+	// the resource already there counts as done
+	create := n == 3 && args[2] == "create"
+	attempt := 0
+
+	var out string
+	err := g.Retry.Do(ctx, "gcloud "+strings.Join(args[:n], " "), func() error {
+		attempt++
+		var err error
+		out, err = g.exec(ctx, args)
+		if err != nil && create && attempt > 1 && strings.Contains(err.Error(), "already exists") {
+			return nil
+		}
+		return err
+	})
+	return out, err
+}
+
+func (g *GCloud) exec(ctx context.Context, args []string) (string, error) {
+	if g.Account != "" {
+		args = append(args, "--account="+g.Account)
+	}
+	if g.ImpersonateServiceAccount != "" {
+		args = append(args, "--impersonate-service-account="+g.ImpersonateServiceAccount)
+	}
+
 	var stdout, stderr bytes.Buffer
-	cmd := exec.Command("gcloud", args...)
+	cmd := exec.CommandContext(ctx, "gcloud", args...)
+	if g.CredentialsFile != "" {
+		cmd.Env = append(os.Environ(), "CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE="+g.CredentialsFile)
+	}
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	err := cmd.Run()
@@ -57,10 +119,46 @@ func (ip *IP) Reserve() (string, error) {
 		"--network-tier=PREMIUM",
 		"--ip-version=IPV4",
 		"--global",
+		"--description="+ip.g.Description,
 		"--project="+ip.g.Project,
 	})
 }
 
+func (ip *IP) GetDescription() (string, error) {
+	return ip.g.Exec([]string{
+		"compute",
+		"addresses",
+		"describe",
+		ip.g.Bucket+"-ip",
+		"--global",
+		"--format=value(description)",
+		"--project="+ip.g.Project,
+	})
+}
+
+// Address returns the reserved IP address and whether it's RESERVED or IN_USE
+func (ip *IP) Address() (string, string, error) {
+	out, err := ip.g.Exec([]string{
+		"compute",
+		"addresses",
+		"describe",
+		ip.g.Bucket+"-ip",
+		"--global",
+		"--format=value(address,status)",
+		"--project="+ip.g.Project,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected address description %q", out)
+	}
+
+	return fields[0], fields[1], nil
+}
+
 func (ip *IP) Exists() bool {
 	_, err := ip.g.Exec([]string{
 		"compute",
@@ -100,6 +198,46 @@ func (b *BackendBucket) Create() (string, error) {
 		b.g.Bucket+"-backend-bucket",
 		"--gcs-bucket-name="+b.g.Bucket,
 		"--enable-cdn",
+		"--description="+b.g.Description,
+		"--project="+b.g.Project,
+	})
+}
+
+func (b *BackendBucket) GetDescription() (string, error) {
+	return b.g.Exec([]string{
+		"compute",
+		"backend-buckets",
+		"describe",
+		b.g.Bucket+"-backend-bucket",
+		"--format=value(description)",
+		"--project="+b.g.Project,
+	})
+}
+
+// HasSignedURLKey reports whether Cloud CDN signs requests to the bucket
+func (b *BackendBucket) HasSignedURLKey() bool {
+	out, err := b.g.Exec([]string{
+		"compute",
+		"backend-buckets",
+		"describe",
+		b.g.Bucket+"-backend-bucket",
+		"--format=value(cdnPolicy.signedUrlKeyNames)",
+		"--project="+b.g.Project,
+	})
+
+	return err == nil && out != ""
+}
+
+// AddSignedURLKey configures Cloud CDN to sign its requests to a private bucket
+// with the 128-bit base64url key in keyFile
+func (b *BackendBucket) AddSignedURLKey(keyFile string) (string, error) {
+	return b.g.Exec([]string{
+		"compute",
+		"backend-buckets",
+		"add-signed-url-key",
+		b.g.Bucket+"-backend-bucket",
+		"--key-name="+b.g.Bucket+"-key",
+		"--key-file="+keyFile,
 		"--project="+b.g.Project,
 	})
 }
@@ -139,10 +277,144 @@ func (u *URLMap) Create() (string, error) {
 		"create",
 		u.g.Bucket+"-lb",
 		"--default-backend-bucket="+u.g.Bucket+"-backend-bucket",
+		"--description="+u.g.Description,
+		"--project="+u.g.Project,
+	})
+}
+
+func (u *URLMap) GetDescription() (string, error) {
+	return u.g.Exec([]string{
+		"compute",
+		"url-maps",
+		"describe",
+		u.g.Bucket+"-lb",
+		"--format=value(description)",
+		"--project="+u.g.Project,
+	})
+}
+
+// url map which rewrites every request path to start with the deployment
+// prefix, so switching deployments is a single atomic import. The forwarding
+// rule makes a classic load balancer, which takes a urlRewrite in the path
+// matcher's defaultRouteAction but not routeRules.
+const routedURLMap = `name: %[1]s
+description: %[4]q
+defaultService: %[2]s
+hostRules:
+- hosts:
+  - '*'
+  pathMatcher: deployment
+pathMatchers:
+- name: deployment
+  defaultService: %[2]s
+  defaultRouteAction:
+    urlRewrite:
+      pathPrefixRewrite: /%[3]s
+`
+
+// url map which sends every request to the bucket unchanged, as Create does
+const plainURLMap = `name: %[1]s
+description: %[3]q
+defaultService: %[2]s
+`
+
+func (u *URLMap) backend() string {
+	return "https://www.googleapis.com/compute/v1/projects/" + u.g.Project +
+		"/global/backendBuckets/" + u.g.Bucket + "-backend-bucket"
+}
+
+// Route switches the load balancer to serve objects under prefix
+func (u *URLMap) Route(prefix string) (string, error) {
+	return u.importMap(fmt.Sprintf(routedURLMap, u.g.Bucket+"-lb", u.backend(), prefix, u.g.Description))
+}
+
+// Unroute drops the path rewrite so the load balancer serves the bucket root
+func (u *URLMap) Unroute() (string, error) {
+	return u.importMap(fmt.Sprintf(plainURLMap, u.g.Bucket+"-lb", u.backend(), u.g.Description))
+}
+
+// IsRouted reports whether the load balancer rewrites paths to a deployment
+func (u *URLMap) IsRouted() (bool, error) {
+	out, err := u.g.Exec([]string{
+		"compute",
+		"url-maps",
+		"describe",
+		u.g.Bucket+"-lb",
+		"--format=value(pathMatchers[].name)",
+		"--project="+u.g.Project,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return out != "", nil
+}
+
+func (u *URLMap) importMap(contents string) (string, error) {
+	f, err := os.CreateTemp("", "url-map-*.yaml")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(contents); err != nil {
+		f.Close()
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	// check the map first, so a bad one is reported instead of half applied
+	if err := u.validate(f.Name()); err != nil {
+		return "", err
+	}
+
+	return u.g.Exec([]string{
+		"compute",
+		"url-maps",
+		"import",
+		u.g.Bucket+"-lb",
+		"--source="+f.Name(),
+		"--global",
+		"--quiet",
 		"--project="+u.g.Project,
 	})
 }
 
+func (u *URLMap) validate(source string) error {
+	out, err := u.g.Exec([]string{
+		"compute",
+		"url-maps",
+		"validate",
+		"--source="+source,
+		"--global",
+		"--load-balancing-scheme=EXTERNAL",
+		"--format=json",
+		"--project="+u.g.Project,
+	})
+	if err != nil {
+		return err
+	}
+
+	var res struct {
+		Result struct {
+			LoadSucceeded bool `json:"loadSucceeded"`
+			LoadErrors []string `json:"loadErrors"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		return fmt.Errorf("unexpected url map validation result %q", out)
+	}
+
+	if !res.Result.LoadSucceeded {
+		return fmt.Errorf("url map is invalid: %s", strings.Join(res.Result.LoadErrors, "; "))
+	}
+
+	return nil
+}
+
 func (u *URLMap) Exists() bool {
 	_, err := u.g.Exec([]string{
 		"compute",
@@ -179,6 +451,18 @@ func (p *Proxy) Create(which string) (string, error) {
 		"create", p.g.Bucket+"-lb-proxy",
 		"--url-map="+p.g.Bucket+"-lb",
 		"--ssl-certificates="+p.g.Bucket+"-cert",
+		"--description="+p.g.Description,
+		"--project="+p.g.Project,
+	})
+}
+
+func (p *Proxy) GetDescription(which string) (string, error) {
+	return p.g.Exec([]string{
+		"compute",
+		"target-"+which+"-proxies",
+		"describe",
+		p.g.Bucket+"-lb-proxy",
+		"--format=value(description)",
 		"--project="+p.g.Project,
 	})
 }
@@ -221,6 +505,19 @@ func (f *ForwardRule) Create() (string, error) {
 		"--global",
 		"--target-https-proxy="+f.g.Bucket+"-lb-proxy",
 		"--ports=443",
+		"--description="+f.g.Description,
+		"--project="+f.g.Project,
+	})
+}
+
+func (f *ForwardRule) GetDescription() (string, error) {
+	return f.g.Exec([]string{
+		"compute",
+		"forwarding-rules",
+		"describe",
+		f.g.Bucket+"-lb-forwarding-rule",
+		"--global",
+		"--format=value(description)",
 		"--project="+f.g.Project,
 	})
 }
@@ -261,8 +558,56 @@ func (s *SSLCert) Create(domain string) (string, error) {
 		"ssl-certificates",
 		"create", s.g.Bucket+"-cert",
 		"--domains="+domain, "--global",
+		"--description="+s.g.Description,
+		"--project="+s.g.Project,
+	})
+}
+
+func (s *SSLCert) GetDescription() (string, error) {
+	return s.g.Exec([]string{
+		"compute",
+		"ssl-certificates",
+		"describe",
+		s.g.Bucket+"-cert",
+		"--global",
+		"--format=value(description)",
+		"--project="+s.g.Project,
+	})
+}
+
+// ManagedStatus is the provisioning state of a Google-managed certificate
+type ManagedStatus struct {
+	// PROVISIONING, ACTIVE, RENEWAL_FAILED or PROVISIONING_FAILED
+	Status string `json:"status"`
+	// per domain PROVISIONING, ACTIVE or one of the FAILED_ states
+	DomainStatus map[string]string `json:"domainStatus"`
+}
+
+func (s *SSLCert) ManagedStatus() (*ManagedStatus, error) {
+	out, err := s.g.Exec([]string{
+		"compute",
+		"ssl-certificates",
+		"describe",
+		s.g.Bucket+"-cert",
+		"--global",
+		"--format=json(managed)",
 		"--project="+s.g.Project,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	var cert struct {
+		Managed *ManagedStatus `json:"managed"`
+	}
+	if err := json.Unmarshal([]byte(out), &cert); err != nil {
+		return nil, err
+	}
+	if cert.Managed == nil {
+		return nil, errors.New("certificate is not Google-managed")
+	}
+
+	return cert.Managed, nil
 }
 
 func (s *SSLCert) Exists() bool {
@@ -287,4 +632,141 @@ func (s *SSLCert) Destroy() (string, error) {
 		"delete",
 		s.g.Bucket+"-cert",
 	})
+}
+
+// StorageBucket covers Cloud Storage settings the Go client doesn't expose
+type StorageBucket struct {
+	g *GCloud
+}
+
+// GrantCDNFill lets the project's Cloud CDN fill service account read objects
+// from a private bucket
+func (s *StorageBucket) GrantCDNFill() (string, error) {
+	number, err := s.g.Exec([]string{
+		"projects",
+		"describe",
+		s.g.Project,
+		"--format=value(projectNumber)",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return s.g.Exec([]string{
+		"storage",
+		"buckets",
+		"add-iam-policy-binding",
+		"gs://"+s.g.Bucket,
+		"--member=serviceAccount:service-"+number+"@cloud-cdn-fill.iam.gserviceaccount.com",
+		"--role=roles/storage.objectViewer",
+		"--project="+s.g.Project,
+	})
+}
+
+// SetNotFoundPage points the bucket's website 404 page at object
+func (s *StorageBucket) SetNotFoundPage(object string) (string, error) {
+	return s.g.Exec([]string{
+		"storage",
+		"buckets",
+		"update",
+		"gs://"+s.g.Bucket,
+		"--web-error-page="+object,
+		"--project="+s.g.Project,
+	})
+}
+
+func (s *StorageBucket) AutoclassEnabled() (bool, error) {
+	out, err := s.g.Exec([]string{
+		"storage",
+		"buckets",
+		"describe",
+		"gs://"+s.g.Bucket,
+		"--format=value(autoclass.enabled)",
+		"--project="+s.g.Project,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return strings.EqualFold(out, "true"), nil
+}
+
+func (s *StorageBucket) SetAutoclass(enabled bool) (string, error) {
+	flag := "--enable-autoclass"
+	if !enabled {
+		flag = "--no-enable-autoclass"
+	}
+
+	return s.g.Exec([]string{
+		"storage",
+		"buckets",
+		"update",
+		"gs://"+s.g.Bucket,
+		flag,
+		"--project="+s.g.Project,
+	})
+}
+
+type KMS struct {
+	g *GCloud
+}
+
+// KeyMembers lists the members granted role directly on the key
+func (k *KMS) KeyMembers(key, role string) ([]string, error) {
+	out, err := k.g.Exec([]string{
+		"kms",
+		"keys",
+		"get-iam-policy",
+		key,
+		"--flatten=bindings[].members",
+		"--filter=bindings.role="+role,
+		"--format=value(bindings.members)",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(out), nil
+}
+
+// ProjectMembers lists the members granted role on the whole project, which
+// also applies to every key in it
+func (k *KMS) ProjectMembers(project, role string) ([]string, error) {
+	out, err := k.g.Exec([]string{
+		"projects",
+		"get-iam-policy",
+		project,
+		"--flatten=bindings[].members",
+		"--filter=bindings.role="+role,
+		"--format=value(bindings.members)",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(out), nil
+}
+
+type Auth struct {
+	g *GCloud
+}
+
+// ActiveAccount returns the account gcloud runs commands as
+func (a *Auth) ActiveAccount() (string, error) {
+	return a.g.Exec([]string{
+		"auth",
+		"list",
+		"--filter=status:ACTIVE",
+		"--format=value(account)",
+	})
+}
+
+// CheckToken fails when the active account's credentials can't be used,
+// such as when they have expired or been revoked
+func (a *Auth) CheckToken() error {
+	_, err := a.g.Exec([]string{
+		"auth",
+		"print-access-token",
+	})
+	return err
 }
\ No newline at end of file
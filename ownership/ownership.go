@@ -0,0 +1,124 @@
+package ownership
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/waypoint-plugin-sdk/component"
+)
+
+// label keys stamped on every resource the plugin creates
+const (
+	PluginKey    = "waypoint-plugin"
+	AppKey       = "waypoint-app"
+	WorkspaceKey = "waypoint-workspace"
+	ProjectKey   = "waypoint-project"
+
+	Plugin = "gcp-cdn"
+)
+
+// Owner identifies the app, workspace and GCP project a resource was created for
+type Owner struct {
+	App       string
+	Workspace string
+	Project   string
+}
+
+// For returns the owner of resources created for the app and workspace of the
+// running job
+func For(src *component.Source, job *component.JobInfo, project string) Owner {
+	owner := Owner{Project: project}
+	if src != nil {
+		owner.App = src.App
+	}
+	if job != nil {
+		owner.Workspace = job.Workspace
+	}
+
+	return owner
+}
+
+// Labels returns the ownership labels, with values cleaned up to satisfy GCP's
+// label rules
+func (o Owner) Labels() map[string]string {
+	return map[string]string{
+		PluginKey:    Plugin,
+		AppKey:       labelValue(o.App),
+		WorkspaceKey: labelValue(o.Workspace),
+		ProjectKey:   labelValue(o.Project),
+	}
+}
+
+// Description is the ownership labels in a form that fits a resource
+// description, for compute resources that don't take labels
+func (o Owner) Description() string {
+	labels := o.Labels()
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+
+	return "managed by waypoint: " + strings.Join(pairs, ",")
+}
+
+// Owns reports whether labels carry every ownership label of o
+func (o Owner) Owns(labels map[string]string) bool {
+	for k, v := range o.Labels() {
+		if labels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// OwnsDescription is Owns for a resource stamped through its description
+func (o Owner) OwnsDescription(description string) bool {
+	return description == o.Description()
+}
+
+// Refusal explains why a resource without matching labels was left alone
+func Refusal(resource string) error {
+	return fmt.Errorf("refusing to destroy %s because it wasn't created by this plugin for this app and workspace, "+
+		"set force = true to destroy it anyway", resource)
+}
+
+// IsReserved reports whether a user supplied label would clash with the
+// ownership labels
+func IsReserved(key string) bool {
+	switch key {
+	case PluginKey, AppKey, WorkspaceKey, ProjectKey:
+		return true
+	}
+
+	return false
+}
+
+// labelValue lowercases v and replaces anything GCP doesn't allow in a label
+// value, truncating to the 63 character limit
+func labelValue(v string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(v) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	s := b.String()
+	if len(s) > 63 {
+		s = s[:63]
+	}
+
+	return s
+}
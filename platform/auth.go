@@ -1,71 +1,321 @@
 package platform
 
-// Comment out the following functions to implement Authentication in
-// your component
-
-//func (p *Platform) ValidateAuthFunc() interface{} {
-//	return p.validateAuth
-//}
-//
-//// AuthFunc satisfies the Authenticator interface
-//func (p *Platform) AuthFunc() interface{} {
-//	return r.authenticate
-//}
-
-// A ValidateAuthFunc does not have a strict signature, you can define the parameters
-// you need based on the Available parameters that the Waypoint SDK provides.
-// Waypoint will automatically inject parameters as specified
-// in the signature at run time.
-//
-// Available input parameters:
-// - context.Context
-// - *component.Source
-// - *component.JobInfo
-// - *component.DeploymentConfig
-// - *datadir.Project
-// - *datadir.App
-// - *datadir.Component
-// - hclog.Logger
-// - terminal.UI
-// - *component.LabelSet
-//
-// If an error is returned, Waypoint will attempt to call
-// AuthFunc
-//func (p *Platform) validateAuth(
-//	ctx context.Context,
-//	ui terminal.UI,
-//) error {
-//	s := ui.Status()
-//	defer s.Close()
-//	s.Update("Validate authentication")
-//
-//	return fmt.Errorf("Unable to Authenticate")
-//}
-
-// A AuthFunc does not have a strict signature, you can define the parameters
-// you need based on the Available parameters that the Waypoint SDK provides.
-// Waypoint will automatically inject parameters as specified
-// in the signature at run time.
-//
-// Available input parameters:
-// - context.Context
-// - *component.Source
-// - *component.JobInfo
-// - *component.DeploymentConfig
-// - *datadir.Project
-// - *datadir.App
-// - *datadir.Component
-// - hclog.Logger
-// - terminal.UI
-// - *component.LabelSet
-//
-// Output parameters must be *component.AuthResult, error
-//func (p *Platform) authenticate(
-//	ctx context.Context,
-//	ui terminal.UI,
-//) (*component.AuthResult, error) {
-//
-//	ui.Output("Describe the manual authentication steps here")
-//
-//	return &component.AuthResult{Authenticated: false}, nil
-//}
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/waypoint-plugin-sdk/component"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/gcloud"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/retry"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+var _ component.Authenticator = (*Platform)(nil)
+
+func (p *Platform) ValidateAuthFunc() interface{} {
+	return p.validateAuth
+}
+
+// AuthFunc satisfies the Authenticator interface
+func (p *Platform) AuthFunc() interface{} {
+	return p.authenticate
+}
+
+// authCheck is one credential check, with the steps that fix it when it fails
+type authCheck struct {
+	Name        string
+	Err         error
+	Remediation []string
+}
+
+// checkAuth verifies that Application Default Credentials reach Cloud Storage,
+// that gcloud is logged in and that both run as the configured account
+func (p *Platform) checkAuth(ctx context.Context, log hclog.Logger) []authCheck {
+	checks := []authCheck{}
+
+	check := authCheck{Name: "Application Default Credentials"}
+	creds, err := p.baseCredentials(ctx)
+	if err != nil {
+		check.Err = err
+		check.Remediation = []string{
+			"Run: gcloud auth application-default login",
+			"Or set GOOGLE_APPLICATION_CREDENTIALS to the path of a service account key file",
+		}
+		if p.config.CredentialsFile != "" {
+			check.Name = "Credentials file"
+			check.Remediation = []string{
+				fmt.Sprintf("Check that %s exists and is a service account key file", p.config.CredentialsFile),
+				"Create a new key with: gcloud iam service-accounts keys create FILE --iam-account=ACCOUNT",
+			}
+		}
+	}
+	checks = append(checks, check)
+
+	// the rest of the storage checks need working credentials
+	if err == nil {
+		checks = append(checks, p.checkStorageAccess(ctx))
+
+		// user credentials don't say who they belong to
+		account := credentialsAccount(creds.JSON)
+		if p.config.ImpersonateServiceAccount != "" {
+			account = p.config.ImpersonateServiceAccount
+		}
+		if p.config.Account != "" && account == "" {
+			log.Debug("could not determine the account of application default credentials")
+		} else if p.config.Account != "" {
+			check := authCheck{Name: "Application Default Credentials account"}
+			if !strings.EqualFold(account, p.config.Account) {
+				check.Err = fmt.Errorf("credentials belong to %s, expected %s", account, p.config.Account)
+				check.Remediation = []string{
+					"Run: gcloud auth application-default login, signing in as " + p.config.Account,
+					"Or point GOOGLE_APPLICATION_CREDENTIALS at a key file for " + p.config.Account,
+				}
+			}
+			checks = append(checks, check)
+		}
+	}
+
+	gc := p.gcloud(ctx, nil)
+
+	check = authCheck{Name: "gcloud credentials"}
+	if err := gc.Auth.CheckToken(); err != nil {
+		check.Err = err
+		check.Remediation = []string{
+			"Install the Google Cloud SDK if gcloud isn't on the PATH: https://cloud.google.com/sdk/docs/install",
+			"Run: gcloud auth login",
+		}
+		if p.config.GCloudAccount != "" {
+			check.Remediation[1] = "Run: gcloud auth login " + p.config.GCloudAccount
+		}
+		if p.config.ImpersonateServiceAccount != "" {
+			check.Remediation = append(check.Remediation, impersonationRemediation(p.config.ImpersonateServiceAccount))
+		}
+	}
+	checks = append(checks, check)
+
+	if check.Err == nil && p.config.Account != "" {
+		check := authCheck{Name: "gcloud account"}
+
+		// an explicit account or impersonation overrides the active account
+		var err error
+		account := p.config.ImpersonateServiceAccount
+		if account == "" {
+			account = p.config.GCloudAccount
+		}
+		if account == "" {
+			account, err = gc.Auth.ActiveAccount()
+		}
+		if err == nil && !strings.EqualFold(account, p.config.Account) {
+			err = fmt.Errorf("gcloud is logged in as %q, expected %s", account, p.config.Account)
+		}
+		if err != nil {
+			check.Err = err
+			check.Remediation = []string{
+				"Run: gcloud config set account " + p.config.Account,
+				"If the account isn't listed by gcloud auth list, run: gcloud auth login " + p.config.Account,
+			}
+		}
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+// checkStorageAccess makes an authenticated call against the bucket, a
+// missing bucket is fine since the deploy creates it
+func (p *Platform) checkStorageAccess(ctx context.Context) authCheck {
+	check := authCheck{Name: "Cloud Storage access"}
+
+	client, err := p.storageClient(ctx)
+	if err != nil {
+		check.Err = err
+		check.Remediation = []string{"Run: gcloud auth application-default login"}
+		if p.config.ImpersonateServiceAccount != "" {
+			check.Remediation = append(check.Remediation, impersonationRemediation(p.config.ImpersonateServiceAccount))
+		}
+		return check
+	}
+	defer client.Close()
+
+	_, err = client.Bucket(p.config.Bucket).Attrs(ctx)
+	if err == nil || err == storage.ErrBucketNotExist {
+		return check
+	}
+
+	check.Err = err
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == 403 {
+		check.Remediation = []string{
+			fmt.Sprintf("Grant the account roles/storage.admin on project %s:", p.config.Project),
+			fmt.Sprintf("gcloud projects add-iam-policy-binding %s --member=ACCOUNT --role=roles/storage.admin", p.config.Project),
+		}
+	} else {
+		check.Remediation = []string{
+			"Refresh expired or revoked credentials: gcloud auth application-default login",
+		}
+	}
+	if p.config.ImpersonateServiceAccount != "" {
+		check.Remediation = append(check.Remediation, impersonationRemediation(p.config.ImpersonateServiceAccount))
+	}
+
+	return check
+}
+
+func impersonationRemediation(account string) string {
+	return fmt.Sprintf("Grant the base credentials roles/iam.serviceAccountTokenCreator on %[1]s: "+
+		"gcloud iam service-accounts add-iam-policy-binding %[1]s --member=ACCOUNT --role=roles/iam.serviceAccountTokenCreator", account)
+}
+
+// baseCredentials loads the configured key file, falling back to Application
+// Default Credentials
+func (p *Platform) baseCredentials(ctx context.Context) (*google.Credentials, error) {
+	if p.config.CredentialsFile == "" {
+		return google.FindDefaultCredentials(ctx, storage.ScopeFullControl)
+	}
+
+	data, err := os.ReadFile(p.config.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return google.CredentialsFromJSON(ctx, data, storage.ScopeFullControl)
+}
+
+// storageClient connects to Cloud Storage as the configured identity
+func (p *Platform) storageClient(ctx context.Context) (*storage.Client, error) {
+	opts := []option.ClientOption{}
+	if p.config.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(p.config.CredentialsFile))
+	}
+
+	if p.config.ImpersonateServiceAccount != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: p.config.ImpersonateServiceAccount,
+			Scopes:          []string{storage.ScopeFullControl},
+		}, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to impersonate %s: %s", p.config.ImpersonateServiceAccount, err.Error())
+		}
+
+		opts = []option.ClientOption{option.WithTokenSource(ts)}
+	}
+
+	return storage.NewClient(ctx, opts...)
+}
+
+// gcloud returns a gcloud client that runs as the same identity as the
+// storage client
+func (p *Platform) gcloud(ctx context.Context, policy *retry.Policy) *gcloud.GCloud {
+	gc := gcloud.Init(p.config.Project, p.config.Bucket)
+	gc.Retry = policy
+	gc.Context = ctx
+	gc.Account = p.config.GCloudAccount
+	gc.ImpersonateServiceAccount = p.config.ImpersonateServiceAccount
+	gc.CredentialsFile = p.config.CredentialsFile
+
+	return gc
+}
+
+// ValidateImpersonation checks the impersonate_service_account setting shared by
+// the platform and release configs, which may be left unset
+func ValidateImpersonation(sa string) error {
+	if sa != "" && !strings.Contains(sa, "@") {
+		return fmt.Errorf("impersonate_service_account must be a service account email, got %q", sa)
+	}
+
+	return nil
+}
+
+// credentialsAccount returns the account of a service account key or external
+// account file, empty for user credentials and metadata server credentials
+func credentialsAccount(data []byte) string {
+	var f struct {
+		ClientEmail                    string `json:"client_email"`
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if len(data) == 0 || json.Unmarshal(data, &f) != nil {
+		return ""
+	}
+
+	if f.ClientEmail != "" {
+		return f.ClientEmail
+	}
+
+	// .../serviceAccounts/NAME@PROJECT.iam.gserviceaccount.com:generateAccessToken
+	if i := strings.LastIndex(f.ServiceAccountImpersonationURL, "/"); i >= 0 {
+		return strings.TrimSuffix(f.ServiceAccountImpersonationURL[i+1:], ":generateAccessToken")
+	}
+
+	return ""
+}
+
+func (p *Platform) validateAuth(
+	ctx context.Context,
+	ui terminal.UI,
+	log hclog.Logger,
+) error {
+	u := ui.Status()
+	defer u.Close()
+	u.Update("Validating Google Cloud authentication...")
+
+	failures := []authCheck{}
+	for _, check := range p.checkAuth(ctx, log) {
+		if check.Err != nil {
+			failures = append(failures, check)
+			u.Step(terminal.StatusError, fmt.Sprintf("%s: %s", check.Name, check.Err.Error()))
+		} else {
+			u.Step(terminal.StatusOK, check.Name)
+		}
+	}
+
+	if len(failures) > 0 {
+		u.Close()
+		outputRemediation(ui, failures)
+		return fmt.Errorf("%d Google Cloud authentication checks failed", len(failures))
+	}
+
+	return nil
+}
+
+// authenticate can't log in on the user's behalf, so it prints the steps
+// that fix each failing check
+func (p *Platform) authenticate(
+	ctx context.Context,
+	ui terminal.UI,
+	log hclog.Logger,
+) (*component.AuthResult, error) {
+	failures := []authCheck{}
+	for _, check := range p.checkAuth(ctx, log) {
+		if check.Err != nil {
+			failures = append(failures, check)
+		}
+	}
+
+	if len(failures) == 0 {
+		return &component.AuthResult{Authenticated: true}, nil
+	}
+
+	outputRemediation(ui, failures)
+
+	return &component.AuthResult{Authenticated: false}, nil
+}
+
+// outputRemediation prints the steps that fix each failed check
+func outputRemediation(ui terminal.UI, failures []authCheck) {
+	ui.Output("Google Cloud authentication needs attention", terminal.WithHeaderStyle())
+
+	for _, check := range failures {
+		ui.Output("%s: %s", check.Name, check.Err.Error(), terminal.WithErrorStyle())
+		for i, step := range check.Remediation {
+			ui.Output("%d. %s", i+1, step, terminal.WithInfoStyle())
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package platform
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/ownership"
+)
+
+// BucketConfig holds the optional bucket_config block, applied when the bucket
+// is created and reconciled on every deploy after that:
+//
+//	bucket_config {
+//	  location      = "NAM4"
+//	  storage_class = "STANDARD"
+//	  versioning    = true
+//	  labels        = { team = "web" }
+//
+//	  lifecycle_rule {
+//	    action          = "Delete"
+//	    noncurrent_days = 30
+//	  }
+//	}
+type BucketConfig struct {
+	// region, multi-region such as "US" or dual-region such as "NAM4",
+	// defaults to the platform's region
+	Location string `hcl:"location,optional"`
+
+	StorageClass string            `hcl:"storage_class,optional"`
+	Versioning   *bool             `hcl:"versioning,optional"`
+	Labels       map[string]string `hcl:"labels,optional"`
+
+	// minimum time objects are kept, e.g. "30d" or "720h". Cloud Storage
+	// doesn't allow it together with versioning.
+	RetentionPeriod string `hcl:"retention_period,optional"`
+
+	// Autoclass isn't exposed by the Cloud Storage client, so it's set with gcloud
+	Autoclass *bool `hcl:"autoclass,optional"`
+
+	Lifecycle []*LifecycleRule `hcl:"lifecycle_rule,block"`
+}
+
+// LifecycleRule deletes or changes the storage class of objects matching
+// every condition that is set
+type LifecycleRule struct {
+	// "Delete" or "SetStorageClass"
+	Action       string `hcl:"action"`
+	StorageClass string `hcl:"storage_class,optional"`
+
+	AgeDays               int64    `hcl:"age_days,optional"`
+	NoncurrentDays        int64    `hcl:"noncurrent_days,optional"`
+	NumNewerVersions      int64    `hcl:"num_newer_versions,optional"`
+	MatchesStorageClasses []string `hcl:"matches_storage_classes,optional"`
+	// "live", "noncurrent" or "any" (default)
+	State string `hcl:"state,optional"`
+}
+
+var storageClasses = map[string]bool{
+	"STANDARD": true,
+	"NEARLINE": true,
+	"COLDLINE": true,
+	"ARCHIVE":  true,
+}
+
+func (b *BucketConfig) validate() error {
+	if b == nil {
+		return nil
+	}
+
+	if b.StorageClass != "" && !storageClasses[b.StorageClass] {
+		return fmt.Errorf("bucket_config storage_class %q is not a valid storage class", b.StorageClass)
+	}
+
+	retention, err := parseRetention(b.RetentionPeriod)
+	if err != nil {
+		return err
+	}
+
+	if retention > 0 && b.Versioning != nil && *b.Versioning {
+		return fmt.Errorf("bucket_config retention_period can't be used with versioning = true, Cloud Storage doesn't allow both on a bucket")
+	}
+
+	for k := range b.Labels {
+		if ownership.IsReserved(k) {
+			return fmt.Errorf("bucket_config label %q is reserved for ownership labels set by the plugin", k)
+		}
+	}
+
+	for _, rule := range b.Lifecycle {
+		if _, err := rule.lifecycleRule(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseRetention accepts Go durations plus a "d" suffix for whole days
+func parseRetention(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err == nil {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("bucket_config retention_period %q is not a valid duration", s)
+	}
+
+	return d, nil
+}
+
+func (r *LifecycleRule) lifecycleRule() (storage.LifecycleRule, error) {
+	rule := storage.LifecycleRule{
+		Action: storage.LifecycleAction{Type: r.Action},
+		Condition: storage.LifecycleCondition{
+			AgeInDays:               r.AgeDays,
+			DaysSinceNoncurrentTime: r.NoncurrentDays,
+			NumNewerVersions:        r.NumNewerVersions,
+			MatchesStorageClasses:   r.MatchesStorageClasses,
+		},
+	}
+
+	switch r.Action {
+	case storage.DeleteAction:
+	case storage.SetStorageClassAction:
+		if !storageClasses[r.StorageClass] {
+			return rule, fmt.Errorf("lifecycle_rule storage_class %q is not a valid storage class", r.StorageClass)
+		}
+		rule.Action.StorageClass = r.StorageClass
+	default:
+		return rule, fmt.Errorf("lifecycle_rule action must be %q or %q", storage.DeleteAction, storage.SetStorageClassAction)
+	}
+
+	switch r.State {
+	case "", "any":
+		rule.Condition.Liveness = storage.LiveAndArchived
+	case "live":
+		rule.Condition.Liveness = storage.Live
+	case "noncurrent":
+		rule.Condition.Liveness = storage.Archived
+	default:
+		return rule, fmt.Errorf("lifecycle_rule state must be one of \"live\", \"noncurrent\" or \"any\"")
+	}
+
+	return rule, nil
+}
+
+func (b *BucketConfig) lifecycle() *storage.Lifecycle {
+	lc := &storage.Lifecycle{}
+	for _, r := range b.Lifecycle {
+		// already checked by validate
+		rule, _ := r.lifecycleRule()
+		lc.Rules = append(lc.Rules, rule)
+	}
+
+	return lc
+}
+
+// createAttrs returns the attributes a new bucket is created with, stamped
+// with the owner's labels
+func (b *BucketConfig) createAttrs(region, kmsKey string, owner map[string]string) *storage.BucketAttrs {
+	attrs := &storage.BucketAttrs{Location: region, LocationType: "region", Labels: map[string]string{}}
+
+	if kmsKey != "" {
+		attrs.Encryption = &storage.BucketEncryption{DefaultKMSKeyName: kmsKey}
+	}
+
+	for k, v := range owner {
+		attrs.Labels[k] = v
+	}
+
+	if b == nil {
+		return attrs
+	}
+
+	if b.Location != "" {
+		attrs.Location = b.Location
+		attrs.LocationType = ""
+	}
+
+	attrs.StorageClass = b.StorageClass
+
+	for k, v := range b.Labels {
+		attrs.Labels[k] = v
+	}
+
+	if b.Versioning != nil {
+		attrs.VersioningEnabled = *b.Versioning
+	}
+
+	if retention, _ := parseRetention(b.RetentionPeriod); retention > 0 {
+		attrs.RetentionPolicy = &storage.RetentionPolicy{RetentionPeriod: retention}
+	}
+
+	if len(b.Lifecycle) > 0 {
+		attrs.Lifecycle = *b.lifecycle()
+	}
+
+	return attrs
+}
+
+// reconcile works out the update that brings an existing bucket in line with
+// the config, along with a description of each change. Settings that aren't
+// configured are left as they are.
+func (b *BucketConfig) reconcile(attrs *storage.BucketAttrs, kmsKey string) (storage.BucketAttrsToUpdate, []string) {
+	update := storage.BucketAttrsToUpdate{}
+	changes := []string{}
+
+	if kmsKey != "" && (attrs.Encryption == nil || attrs.Encryption.DefaultKMSKeyName != kmsKey) {
+		update.Encryption = &storage.BucketEncryption{DefaultKMSKeyName: kmsKey}
+		changes = append(changes, fmt.Sprintf("default KMS key -> %s", kmsKey))
+	}
+
+	if b == nil {
+		return update, changes
+	}
+
+	if b.StorageClass != "" && b.StorageClass != attrs.StorageClass {
+		update.StorageClass = b.StorageClass
+		changes = append(changes, fmt.Sprintf("storage class %s -> %s", attrs.StorageClass, b.StorageClass))
+	}
+
+	if b.Versioning != nil && *b.Versioning != attrs.VersioningEnabled {
+		update.VersioningEnabled = *b.Versioning
+		changes = append(changes, fmt.Sprintf("versioning %t -> %t", attrs.VersioningEnabled, *b.Versioning))
+	}
+
+	if retention, _ := parseRetention(b.RetentionPeriod); retention > 0 &&
+		(attrs.RetentionPolicy == nil || attrs.RetentionPolicy.RetentionPeriod != retention) {
+		update.RetentionPolicy = &storage.RetentionPolicy{RetentionPeriod: retention}
+		changes = append(changes, fmt.Sprintf("retention period -> %s", retention))
+	}
+
+	if len(b.Lifecycle) > 0 {
+		lc := b.lifecycle()
+		if !reflect.DeepEqual(lc.Rules, attrs.Lifecycle.Rules) {
+			update.Lifecycle = lc
+			changes = append(changes, fmt.Sprintf("lifecycle -> %d rules", len(lc.Rules)))
+		}
+	}
+
+	keys := make([]string, 0, len(b.Labels))
+	for k := range b.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if attrs.Labels[k] != b.Labels[k] {
+			update.SetLabel(k, b.Labels[k])
+			changes = append(changes, fmt.Sprintf("label %s=%s", k, b.Labels[k]))
+		}
+	}
+
+	return update, changes
+}
+
+// locationMismatch reports a configured location the bucket wasn't created in,
+// which can't be changed without recreating the bucket
+func (b *BucketConfig) locationMismatch(attrs *storage.BucketAttrs, region string) string {
+	want := region
+	if b != nil && b.Location != "" {
+		want = b.Location
+	}
+
+	if want == "" || strings.EqualFold(want, attrs.Location) {
+		return ""
+	}
+
+	return fmt.Sprintf("bucket %s is in %s, not %s, and its location cannot be changed", attrs.Name, attrs.Location, want)
+}
@@ -0,0 +1,68 @@
+package platform
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// CORSRule is a repeatable cors block. Together they replace the bucket's
+// whole CORS policy on every deploy, so removing every block clears it.
+//
+//	cors {
+//	  origins          = ["https://example.com"]
+//	  methods          = ["GET", "HEAD"]
+//	  response_headers = ["Content-Type"]
+//	  max_age_seconds  = 3600
+//	}
+type CORSRule struct {
+	Origins         []string `hcl:"origins"`
+	Methods         []string `hcl:"methods,optional"`
+	ResponseHeaders []string `hcl:"response_headers,optional"`
+	MaxAgeSeconds   int      `hcl:"max_age_seconds,optional"`
+}
+
+func validateCORS(rules []*CORSRule) error {
+	for _, rule := range rules {
+		if len(rule.Origins) == 0 {
+			return fmt.Errorf("cors origins must list at least one origin")
+		}
+
+		if rule.MaxAgeSeconds < 0 {
+			return fmt.Errorf("cors max_age_seconds must not be negative")
+		}
+	}
+
+	return nil
+}
+
+// corsPolicy converts the cors blocks into the bucket's CORS policy. Methods
+// default to GET and HEAD, which is all a static site serves.
+func corsPolicy(rules []*CORSRule) []storage.CORS {
+	policy := []storage.CORS{}
+	for _, rule := range rules {
+		methods := rule.Methods
+		if len(methods) == 0 {
+			methods = []string{"GET", "HEAD"}
+		}
+
+		policy = append(policy, storage.CORS{
+			Origins:         rule.Origins,
+			Methods:         methods,
+			ResponseHeaders: rule.ResponseHeaders,
+			MaxAge:          time.Duration(rule.MaxAgeSeconds) * time.Second,
+		})
+	}
+
+	return policy
+}
+
+func corsMatches(current, desired []storage.CORS) bool {
+	if len(current) == 0 && len(desired) == 0 {
+		return true
+	}
+
+	return reflect.DeepEqual(current, desired)
+}
@@ -3,15 +3,18 @@ package platform
 import (
 	"context"
 	"fmt"
-	"io"
 	"os"
-	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/iam"
 	"cloud.google.com/go/storage"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/waypoint-plugin-sdk/component"
 	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
-	"google.golang.org/api/iterator"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/ownership"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/retry"
 	iampb "google.golang.org/genproto/googleapis/iam/v1"
 )
 
@@ -38,6 +41,47 @@ func setPublicIAM(
 	return true, nil
 }
 
+// removePublicIAM drops allUsers from the objectViewer binding, if present
+func removePublicIAM(
+	c context.Context,
+	client *storage.Client,
+	bucketName string,
+) error {
+	policy, err := client.Bucket(bucketName).IAM().V3().Policy(c)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, binding := range policy.Bindings {
+		if binding.Role != "roles/storage.objectViewer" || !includesAllUsers(binding.Members) {
+			continue
+		}
+
+		members := []string{}
+		for _, member := range binding.Members {
+			if member != iam.AllUsers {
+				members = append(members, member)
+			}
+		}
+		binding.Members = members
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return client.Bucket(bucketName).IAM().V3().SetPolicy(c, policy)
+}
+
+// suggested whenever the organization prevents public buckets
+const privateModeHint = "set public = false to serve the bucket privately through Cloud CDN instead"
+
+func isPublicAccessPrevented(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "public access prevention")
+}
+
 func includesAllUsers(members []string) bool {
 	for _, member := range members {
 		if member == iam.AllUsers {
@@ -68,80 +112,225 @@ func areObjectsPublic(
 	return false, nil
 }
 
-func detectMimeType(fname string) string {
-	if strings.HasSuffix(fname, ".css") {
-		return "text/css"
-	} else if strings.HasSuffix(fname, ".js") {
-		return "application/javascript"
-	} else if strings.HasSuffix(fname, ".map") {
-		return "binary/octet-stream"
-	} else if strings.HasSuffix(fname, ".svg") {
-		return "image/svg+xml"
+type DeployConfig struct {
+	Bucket       string `hcl:"bucket"`
+	Project      string `hcl:"project"`
+	Region       string `hcl:"region,optional"`
+	Directory    string `hcl:"directory,optional"`
+	IndexPage    string `hcl:"index,optional"`
+	NotFoundPage string `hcl:"not_found,optional"`
+	Concurrency  int    `hcl:"concurrency,optional"`
+
+	// directory that a relative Directory is resolved against, defaults to
+	// the source path of the app being deployed
+	BaseDir string `hcl:"base,optional"`
+
+	// extension to content type overrides, e.g. { ".webmanifest" = "application/json" }
+	ContentTypes map[string]string `hcl:"content_types,optional"`
+
+	// headers applied to uploaded objects by glob, later blocks take precedence
+	Metadata []*MetadataRule `hcl:"metadata,block"`
+
+	// store compressible text assets gzipped with Content-Encoding: gzip, which
+	// Cloud Storage transcodes for clients that don't accept it. Brotli isn't
+	// offered since Cloud Storage can't transcode it.
+	Gzip           bool     `hcl:"gzip,optional"`
+	GzipMinSize    int64    `hcl:"gzip_min_size,optional"`
+	GzipExtensions []string `hcl:"gzip_extensions,optional"`
+
+	// delete objects that no longer exist in the build directory
+	Prune             bool     `hcl:"prune,optional"`
+	ProtectedPrefixes []string `hcl:"protected_prefixes,optional"`
+
+	// upload each deployment under its own prefix and let the release switch
+	// traffic to it, instead of overwriting objects in place
+	Versioned bool `hcl:"versioned,optional"`
+
+	// print what Deploy would change without changing anything. The release
+	// refuses dry runs, so plan with waypoint deploy rather than waypoint up.
+	DryRun bool `hcl:"dry_run,optional"`
+
+	// fail the deploy when any file fails to upload, or when more than
+	// max_failed_files do. Otherwise failures are reported as warnings.
+	FailOnError    bool `hcl:"fail_on_error,optional"`
+	MaxFailedFiles int  `hcl:"max_failed_files,optional"`
+
+	// globs of files to upload, everything when unset
+	Include []string `hcl:"include,optional"`
+	// gitignore style patterns of files to skip, combined with any .cdnignore
+	// file at the root of the build directory. .env files, .git/ and OS
+	// clutter are always skipped unless re-included, e.g. "!.env.example".
+	Exclude []string `hcl:"exclude,optional"`
+
+	// scan files for secrets before publishing them, "warn" (default), "block" or "off"
+	SecretScan string `hcl:"secret_scan,optional"`
+
+	// when false the bucket stays private and the release grants read access
+	// to Cloud CDN alone, for orgs that enforce public access prevention
+	Public *bool `hcl:"public,optional"`
+
+	// Cloud KMS key used as the bucket's default key and for every uploaded
+	// object, projects/P/locations/L/keyRings/R/cryptoKeys/K
+	KMSKey string `hcl:"kms_key,optional"`
+
+	// account Google Cloud credentials are expected to belong to, checked
+	// when Waypoint validates authentication
+	Account string `hcl:"account,optional"`
+
+	// service account key used instead of Application Default Credentials
+	CredentialsFile string `hcl:"credentials_file,optional"`
+
+	// service account every Cloud Storage and gcloud call is made as, which
+	// the base credentials need roles/iam.serviceAccountTokenCreator on
+	ImpersonateServiceAccount string `hcl:"impersonate_service_account,optional"`
+
+	// gcloud account to run commands as, instead of the active one
+	GCloudAccount string `hcl:"gcloud_account,optional"`
+
+	// destroy the bucket even when it lacks this app's ownership labels
+	Force bool `hcl:"force,optional"`
+
+	// settings applied when the bucket is created and reconciled on every deploy
+	BucketConfig *BucketConfig `hcl:"bucket_config,block"`
+
+	// cross-origin access to objects, replaces the bucket's CORS policy on every deploy
+	CORS []*CORSRule `hcl:"cors,block"`
+
+	// backoff for transient Cloud Storage failures
+	Retry *retry.Config `hcl:"retry,block"`
+}
+
+// resolveBuildDir returns the absolute build directory, resolving a relative
+// directory against base or, when that isn't set, the app's source path
+func resolveBuildDir(src *component.Source, base, dir string) string {
+	if filepath.IsAbs(dir) {
+		return dir
 	}
 
-	return ""
+	if base == "" && src != nil {
+		base = src.Path
+	}
+
+	return filepath.Join(base, dir)
 }
 
-func uploadFiles(
-	c context.Context,
-	client *storage.Client,
-	bucketName string,
-	buildDir string,
-	subPath string,
-	errors *[]string,
-) []string {
-	files, err := os.ReadDir(path.Join(buildDir, subPath))
+// this is checked at deploy time rather than in ConfigSet, since the build
+// output doesn't exist when the app is being destroyed
+func validateBuildDir(dir, indexPage string) error {
+	info, err := os.Stat(dir)
 	if err != nil {
-		*errors = append(*errors, err.Error())
+		return fmt.Errorf("build directory %s does not exist", dir)
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			uploadFiles(c, client, bucketName, buildDir, subPath+file.Name()+"/", errors)
-			continue
-		}
+	if !info.IsDir() {
+		return fmt.Errorf("build directory %s is not a directory", dir)
+	}
 
-		f, err := os.Open(path.Join(buildDir, subPath, file.Name()))
-		if err != nil {
-			*errors = append(*errors, err.Error())
-			continue
-		}
-		defer f.Close()
+	if _, err := os.Stat(filepath.Join(dir, indexPage)); err != nil {
+		return fmt.Errorf("index page %s does not exist in build directory %s", indexPage, dir)
+	}
 
-		wc := client.Bucket(bucketName).Object(subPath + file.Name()).NewWriter(c)
-		if _, err = io.Copy(wc, f); err != nil {
-			*errors = append(*errors, err.Error())
-			continue
-		}
+	return nil
+}
 
-		if err := wc.Close(); err != nil {
-			*errors = append(*errors, err.Error())
-			continue
-		}
-		cType := detectMimeType(file.Name())
+func (p *Platform) newUploader(client *storage.Client, policy *retry.Policy, prefix string) *uploader {
+	return &uploader{
+		client:      client,
+		retry:       policy,
+		bucket:      p.config.Bucket,
+		prefix:      prefix,
+		concurrency: p.concurrency(),
 
-		if cType != "" {
-			objectMetadata := storage.ObjectAttrsToUpdate{
-				ContentType: detectMimeType(file.Name()),
-			}
+		contentTypes:  normalizeContentTypes(p.config.ContentTypes),
+		metadataRules: p.config.Metadata,
 
-			if _, err := client.Bucket(bucketName).Object(subPath+file.Name()).Update(c, objectMetadata); err != nil {
-				*errors = append(*errors, err.Error())
-			}
-		}
+		gzip:           p.config.Gzip,
+		gzipMinSize:    p.config.GzipMinSize,
+		gzipExtensions: normalizeExtensions(p.config.GzipExtensions),
+
+		kmsKey: p.config.KMSKey,
 	}
+}
 
-	return *errors
+// never prune versioned deployments or manifests when deploying in place
+func (p *Platform) protectedPrefixes() []string {
+	return append([]string{deploymentsRoot, manifestDir}, p.config.ProtectedPrefixes...)
 }
 
-type DeployConfig struct {
-	Bucket       string `hcl:"bucket"`
-	Project      string `hcl:"project"`
-	Region       string `hcl:"region,optional"`
-	Directory    string `hcl:"directory,optional"`
-	IndexPage    string `hcl:"index,optional"`
-	NotFoundPage string `hcl:"not_found,optional"`
-	BaseDir      string `hcl:"base,optional"`
+// retryPolicy builds the configured retry policy, reporting every retry
+func (p *Platform) retryPolicy(log hclog.Logger, ui terminal.UI) (*retry.Policy, error) {
+	policy, err := p.config.Retry.Policy()
+	if err != nil {
+		return nil, err
+	}
+
+	policy.Notify = retry.Notifier(log, ui)
+
+	return policy, nil
+}
+
+func (p *Platform) concurrency() int {
+	if p.config.Concurrency <= 0 {
+		return defaultConcurrency
+	}
+
+	return p.config.Concurrency
+}
+
+func (p *Platform) isPublic() bool {
+	return p.config.Public == nil || *p.config.Public
+}
+
+func (p *Platform) exceedsFailurePolicy(failed int) bool {
+	if p.config.FailOnError {
+		return failed > 0
+	}
+
+	return p.config.MaxFailedFiles > 0 && failed > p.config.MaxFailedFiles
+}
+
+// objects of versioned deployments live under deployments/<id>/
+const deploymentsRoot = "deployments/"
+
+// websiteNotFoundPage is the 404 page a deploy writes to the bucket. The load
+// balancer rewrites paths but the bucket resolves 404s itself, so versioned
+// deploys leave it alone and the release moves it along with the traffic.
+func (p *Platform) websiteNotFoundPage(attrs *storage.BucketAttrs) string {
+	if !p.config.Versioned {
+		return p.config.NotFoundPage
+	}
+
+	if attrs != nil && attrs.Website != nil {
+		return attrs.Website.NotFoundPage
+	}
+
+	return ""
+}
+
+func releasedNotFoundPage(prefix, notFoundPage string) string {
+	if prefix == "" || notFoundPage == "" {
+		return ""
+	}
+
+	return prefix + notFoundPage
+}
+
+func deploymentPrefix(id string) string {
+	return deploymentsRoot + id + "/"
+}
+
+func (d *Deployment) URL() string { return d.WebsiteUrl }
+
+var _ component.DeploymentWithUrl = (*Deployment)(nil)
+
+// the public Cloud Storage URL of a deployment's index page, which works
+// before the release sets up the load balancer. Private buckets have none.
+func websiteURL(bucket, prefix, indexPage string, public bool) string {
+	if !public {
+		return ""
+	}
+
+	return "https://storage.googleapis.com/" + bucket + "/" + prefix + indexPage
 }
 
 type Platform struct {
@@ -153,54 +342,230 @@ func (p *Platform) DestroyFunc() interface{} {
 	return p.Destroy
 }
 
+// Destroy removes a single deployment. Versioned deployments own their prefix,
+// which is deleted along with the bucket once no other deployment is left in
+// it. Otherwise every deployment shares the bucket root, so its objects may
+// still be live and are left for DestroyWorkspace.
+//
 // If an error is returned, Waypoint stops the execution flow and
 // returns an error to the user.
-func (p *Platform) Destroy(ctx context.Context, ui terminal.UI) error {
+func (p *Platform) Destroy(
+	ctx context.Context,
+	ui terminal.UI,
+	log hclog.Logger,
+	src *component.Source,
+	job *component.JobInfo,
+	deployment *Deployment,
+) error {
 	u := ui.Status()
 	defer u.Close()
 	u.Step("", "---Destroying Cloud Storage Assets---")
 
-	client, err := storage.NewClient(ctx)
+	if deployment.DryRun {
+		u.Step(terminal.StatusOK, "Deployment was a dry run, nothing to destroy")
+		return nil
+	}
+
+	bucket := deployment.Bucket
+	if bucket == "" {
+		bucket = p.config.Bucket
+	}
+
+	policy, err := p.retryPolicy(log, ui)
+	if err != nil {
+		return err
+	}
+
+	client, err := p.storageClient(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to connect to Google Cloud: %s", err.Error())
 	}
 	defer client.Close()
 
-	u.Update("Destroying objects...")
+	if deployment.Prefix == "" {
+		// the manifest is the only object that belongs to this deployment alone
+		if deployment.ManifestObject != "" {
+			err := policy.Do(ctx, "delete manifest", func() error {
+				return client.Bucket(bucket).Object(deployment.ManifestObject).Delete(ctx)
+			})
+			if err != nil && err != storage.ErrObjectNotExist && err != storage.ErrBucketNotExist {
+				return fmt.Errorf("failed to delete manifest: %s", err.Error())
+			}
+		}
+
+		u.Step(terminal.StatusOK, fmt.Sprintf(
+			"Deployment %s shares the bucket root with other deployments, leaving its objects in place", deployment.Id))
+		return nil
+	}
+
+	exists, err := p.checkBucketOwner(ctx, u, client, ownership.For(src, job, p.config.Project), bucket)
+	if err != nil || !exists {
+		return err
+	}
+
+	if err := p.destroyObjects(ctx, ui, u, client, policy, bucket, deployment.Prefix); err != nil {
+		return err
+	}
+
+	// the bucket goes with the last deployment in it
+	var empty bool
+	err = policy.Do(ctx, "list objects", func() (err error) {
+		empty, err = isBucketEmpty(ctx, client, bucket)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %s", err.Error())
+	}
+
+	if empty {
+		if err := destroyBucket(ctx, u, client, policy, bucket); err != nil {
+			return err
+		}
+	}
+
+	u.Step(terminal.StatusOK, "Successfully destroyed Cloud Storage Assets")
+
+	return nil
+}
+
+// Implement the WorkspaceDestroyer interface
+func (p *Platform) DestroyWorkspaceFunc() interface{} {
+	return p.DestroyWorkspace
+}
+
+// DestroyWorkspace runs after every deployment has been destroyed and removes
+// whatever is left in the bucket, then the bucket itself
+func (p *Platform) DestroyWorkspace(
+	ctx context.Context,
+	ui terminal.UI,
+	log hclog.Logger,
+	src *component.Source,
+	job *component.JobInfo,
+) error {
+	u := ui.Status()
+	defer u.Close()
+	u.Step("", "---Destroying Cloud Storage Bucket---")
+
+	policy, err := p.retryPolicy(log, ui)
+	if err != nil {
+		return err
+	}
+
+	client, err := p.storageClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Google Cloud: %s", err.Error())
+	}
+	defer client.Close()
+
+	exists, err := p.checkBucketOwner(ctx, u, client, ownership.For(src, job, p.config.Project), p.config.Bucket)
+	if err != nil {
+		return err
+	}
 
 	// If a bucket already doesn't exist, just short circuit
-	_, err = client.Bucket(p.config.Bucket).Attrs(ctx)
-	if err == storage.ErrBucketNotExist {
+	if !exists {
 		u.Step(terminal.StatusOK, "Successfully destroyed Cloud Storage Assets")
 		return nil
 	}
 
-	it := client.Bucket(p.config.Bucket).Objects(ctx, nil)
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("failed to list object: %s", err.Error())
-		}
+	if err := p.destroyObjects(ctx, ui, u, client, policy, p.config.Bucket, ""); err != nil {
+		return err
+	}
 
-		obj := client.Bucket(p.config.Bucket).Object(attrs.Name)
-		if err := obj.Delete(ctx); err != nil {
-			return fmt.Errorf("failed to destroy object: %s", err.Error())
+	if err := destroyBucket(ctx, u, client, policy, p.config.Bucket); err != nil {
+		return err
+	}
+
+	u.Step(terminal.StatusOK, "Successfully destroyed Cloud Storage Assets")
+
+	return nil
+}
+
+// checkBucketOwner reports whether the bucket exists, failing when it lacks
+// the owner's labels unless force is set
+func (p *Platform) checkBucketOwner(
+	ctx context.Context,
+	u terminal.Status,
+	client *storage.Client,
+	owner ownership.Owner,
+	bucket string,
+) (bool, error) {
+	attrs, err := client.Bucket(bucket).Attrs(ctx)
+	if err == storage.ErrBucketNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get bucket: %s", err.Error())
+	}
+
+	if !owner.Owns(attrs.Labels) {
+		if !p.config.Force {
+			u.Step(terminal.StatusError, fmt.Sprintf("Bucket %s is not owned by this app", bucket))
+			return true, ownership.Refusal("bucket " + bucket)
 		}
+
+		u.Step(terminal.StatusWarn, fmt.Sprintf("Bucket %s is not owned by this app, destroying it anyway", bucket))
+	}
+
+	return true, nil
+}
+
+// destroyObjects deletes every generation of every object under prefix
+func (p *Platform) destroyObjects(
+	ctx context.Context,
+	ui terminal.UI,
+	u terminal.Status,
+	client *storage.Client,
+	policy *retry.Policy,
+	bucket string,
+	prefix string,
+) error {
+	u.Update("Destroying objects...")
+
+	// noncurrent versions have to go too, or the bucket can't be deleted
+	var refs []objectRef
+	err := policy.Do(ctx, "list object versions", func() (err error) {
+		refs, err = listObjectVersions(ctx, client, bucket, prefix)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %s", err.Error())
 	}
 
-	u.Step("", "Destroyed objects")
+	deleted, failures := deleteObjects(ctx, client, policy, bucket, refs, p.concurrency(),
+		func(done, total int) {
+			if done%100 == 0 || done == total {
+				u.Update(fmt.Sprintf("Destroying objects... (%d of %d)", done, total))
+			}
+		})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if len(failures) > 0 {
+		u.Step(terminal.StatusError, fmt.Sprintf("Failed to destroy %d of %d objects", len(failures), len(refs)))
+		u.Close()
+		ui.Table(failureTable(failures))
+		return fmt.Errorf("failed to destroy %d objects, the bucket was left in place", len(failures))
+	}
 
+	u.Step("", fmt.Sprintf("Destroyed %d objects", deleted))
+
+	return nil
+}
+
+func destroyBucket(ctx context.Context, u terminal.Status, client *storage.Client, policy *retry.Policy, bucket string) error {
 	u.Update("Destroying bucket...")
 
-	bkt := client.Bucket(p.config.Bucket)
-	if err := bkt.Delete(ctx); err != nil {
-		return fmt.Errorf("failed to destroy bucket: %s", err.Error())
+	bkt := client.Bucket(bucket)
+	err := policy.Do(ctx, "delete bucket", func() error {
+		return bkt.Delete(ctx)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to destroy bucket: %s", explainDeleteError(err))
 	}
 
-	u.Step(terminal.StatusOK, "Successfully destroyed Cloud Storage Assets")
+	u.Step(terminal.StatusOK, fmt.Sprintf("Destroyed bucket %s", bucket))
 
 	return nil
 }
@@ -219,41 +584,43 @@ func (p *Platform) ConfigSet(config interface{}) error {
 	}
 
 	// validate the config
-	if c.Region == "" {
+	if c.Region == "" && (c.BucketConfig == nil || c.BucketConfig.Location == "") {
 		return fmt.Errorf("region must be set to a valid GCP region")
 	}
 
-	if c.Bucket == "" {
-		return fmt.Errorf("bucket is a required attribute")
+	if err := c.BucketConfig.validate(); err != nil {
+		return err
 	}
 
-	tmpFiles, err := os.ReadDir("/tmp")
-	if err != nil {
-		return fmt.Errorf("error accessing tmp directory")
+	if err := validateCORS(c.CORS); err != nil {
+		return err
 	}
 
-	tmpDir := ""
+	if err := validateKMSKey(c.KMSKey); err != nil {
+		return err
+	}
 
-	for _, file := range tmpFiles {
-		if file.IsDir() && strings.Contains(file.Name(), "waypoint") {
-			tmpDir = file.Name()
-			break
-		}
+	if c.Bucket == "" {
+		return fmt.Errorf("bucket is a required attribute")
 	}
 
-	if tmpDir == "" {
-		return fmt.Errorf("could not find tmp directory for this project")
+	if err := compileMetadataRules(c.Metadata); err != nil {
+		return err
 	}
 
-	c.BaseDir = path.Join("/tmp", tmpDir)
-	c.Directory = path.Join(c.BaseDir, strings.TrimLeft(c.Directory, "./"))
+	if _, err := c.Retry.Policy(); err != nil {
+		return err
+	}
 
-	// TODO: find graceful way to detect if destroying and prevent this error
-	// _, err = os.Stat(c.Directory)
+	if err := ValidateImpersonation(c.ImpersonateServiceAccount); err != nil {
+		return err
+	}
 
-	// if err != nil {
-	// 	return fmt.Errorf("directory you specified does not exist")
-	// }
+	switch c.SecretScan {
+	case "", scanWarn, scanBlock, scanOff:
+	default:
+		return fmt.Errorf("secret_scan must be one of %q, %q or %q", scanWarn, scanBlock, scanOff)
+	}
 
 	return nil
 }
@@ -266,39 +633,180 @@ func (p *Platform) DeployFunc() interface{} {
 
 // If an error is returned, Waypoint stops the execution flow and
 // returns an error to the user.
-func (p *Platform) Deploy(ctx context.Context, ui terminal.UI) (*Deployment, error) {
+func (p *Platform) Deploy(
+	ctx context.Context,
+	ui terminal.UI,
+	log hclog.Logger,
+	src *component.Source,
+	job *component.JobInfo,
+	dc *component.DeploymentConfig,
+) (*Deployment, error) {
 	u := ui.Status()
 	defer u.Close()
 	u.Step("", "---Deploying Cloud Storage Assets---")
 
 	// configure defaults
 	if p.config.Directory == "" {
-		p.config.Directory = "./build"
+		p.config.Directory = "build"
 	}
 
 	if p.config.IndexPage == "" {
 		p.config.IndexPage = "index.html"
 	}
 
-	client, err := storage.NewClient(ctx)
+	if p.config.GzipMinSize <= 0 {
+		p.config.GzipMinSize = defaultGzipMinSize
+	}
+
+	if p.config.GzipExtensions == nil {
+		p.config.GzipExtensions = defaultGzipExtensions
+	}
+
+	if p.config.ProtectedPrefixes == nil {
+		p.config.ProtectedPrefixes = defaultProtectedPrefixes
+	}
+
+	policy, err := p.retryPolicy(log, ui)
+	if err != nil {
+		u.Step(terminal.StatusError, "Invalid retry configuration")
+		return nil, err
+	}
+
+	buildDir := resolveBuildDir(src, p.config.BaseDir, p.config.Directory)
+
+	if err := validateBuildDir(buildDir, p.config.IndexPage); err != nil {
+		u.Step(terminal.StatusError, "Invalid build directory")
+		return nil, err
+	}
+
+	deploymentID := dc.Id
+	if deploymentID == "" {
+		deploymentID = time.Now().UTC().Format("20060102T150405Z")
+	}
+
+	prefix := ""
+	if p.config.Versioned {
+		prefix = deploymentPrefix(deploymentID)
+	}
+
+	filter, err := newFileFilter(buildDir, p.config.Include, p.config.Exclude)
+	if err != nil {
+		u.Step(terminal.StatusError, "Error reading include and exclude patterns")
+		return nil, err
+	}
+
+	files, skipped, err := collectFiles(buildDir, filter)
+	if err != nil {
+		u.Step(terminal.StatusError, fmt.Sprintf("Error reading build directory %s", buildDir))
+		return nil, err
+	}
+
+	if skipped > 0 {
+		u.Step(terminal.StatusOK, fmt.Sprintf("Skipped %d files matching include and exclude patterns", skipped))
+	}
+
+	// everything uploaded becomes public, so look for secrets before touching the bucket
+	var findings []finding
+	if p.config.SecretScan != scanOff {
+		u.Update("Scanning static files for secrets...")
+
+		findings, err = scanFiles(files)
+		if err != nil {
+			u.Step(terminal.StatusError, "Error scanning static files for secrets")
+			return nil, err
+		}
+
+		if len(findings) == 0 {
+			u.Step(terminal.StatusOK, "No secrets found in static files")
+		} else if !p.config.DryRun {
+			status := terminal.StatusWarn
+			if p.config.SecretScan == scanBlock {
+				status = terminal.StatusError
+			}
+
+			u.Step(status, fmt.Sprintf("Found %d possible secrets in static files", len(findings)))
+			u.Close()
+			ui.Table(findingTable(findings))
+
+			if p.config.SecretScan == scanBlock {
+				return nil, fmt.Errorf("refusing to publish files that may contain secrets, exclude them or set secret_scan = \"warn\"")
+			}
+
+			u = ui.Status()
+			defer u.Close()
+		}
+	}
+
+	client, err := p.storageClient(ctx)
 	if err != nil {
 		u.Step(terminal.StatusError, "Error connecting to Cloud Storage API")
 		return nil, err
 	}
 	defer client.Close()
 
+	if p.config.DryRun {
+		u.Close()
+		if err := p.plan(ctx, ui, client, policy, files, skipped, findings, prefix, ownership.For(src, job, p.config.Project)); err != nil {
+			return nil, err
+		}
+
+		u = ui.Status()
+		defer u.Close()
+		u.Step(terminal.StatusOK, "Dry run complete, no changes were made")
+
+		// the release refuses a dry run deployment, status and destroy skip it
+		return &Deployment{
+			Bucket:  p.config.Bucket,
+			Region:  p.config.Region,
+			Project: p.config.Project,
+			Id:      deploymentID,
+			Prefix:  prefix,
+			DryRun:  true,
+		}, nil
+	}
+
+	// grants the check can't see still work, so a failed check only warns and
+	// the hint is attached to whatever the key actually breaks
+	var kmsHint string
+	if p.config.KMSKey != "" {
+		u.Update("Checking access to KMS key...")
+
+		gc := p.gcloud(ctx, policy)
+
+		kmsHint, err = checkKMSAccess(ctx, client, gc, p.config.Project, p.config.KMSKey)
+		if err != nil {
+			u.Step(terminal.StatusWarn, fmt.Sprintf("Could not confirm Cloud Storage can use the configured KMS key: %s", err.Error()))
+			u.Step(terminal.StatusWarn, "If it can't, "+kmsHint)
+		} else {
+			u.Step(terminal.StatusOK, "Cloud Storage can use the configured KMS key")
+		}
+	}
+
 	u.Update("Configuring Cloud Storage bucket...")
 	bkt := client.Bucket(p.config.Bucket)
 
-	attrs, err := bkt.Attrs(ctx)
-	// if this errors out, bucket doesn't exist
-	if err != nil && !strings.Contains(err.Error(), "You already own this bucket") {
+	var attrs *storage.BucketAttrs
+	err = policy.Do(ctx, "get bucket", func() (err error) {
+		attrs, err = bkt.Attrs(ctx)
+		return err
+	})
+	// anything but a missing bucket is usually a credentials problem, which
+	// shouldn't be mistaken for a bucket that needs creating
+	if err != nil && err != storage.ErrBucketNotExist {
+		u.Step(terminal.StatusError, fmt.Sprintf("Error accessing bucket %s", p.config.Bucket))
+		return nil, fmt.Errorf("failed to access bucket %s, check the Google Cloud credentials Waypoint runs with: %s",
+			p.config.Bucket, err.Error())
+	}
+
+	if err == storage.ErrBucketNotExist {
 		u.Update(fmt.Sprintf("Bucket %s not found, creating new one...", p.config.Bucket))
 
-		if err := bkt.Create(ctx, p.config.Project,
-			&storage.BucketAttrs{Location: p.config.Region, LocationType: "region"}); err != nil {
+		err := policy.Do(ctx, "create bucket", func() error {
+			return bkt.Create(ctx, p.config.Project, p.config.BucketConfig.createAttrs(p.config.Region, p.config.KMSKey, ownership.For(src, job, p.config.Project).Labels()))
+		})
+		if err != nil {
 			u.Step(terminal.StatusError, "Error creating new bucket")
-			return nil, err
+			return nil, fmt.Errorf("failed to create bucket: %s", explainKMSError(err, kmsHint))
 		}
 
 		newBktAttrs := storage.BucketAttrsToUpdate{
@@ -307,60 +815,235 @@ func (p *Platform) Deploy(ctx context.Context, ui terminal.UI) (*Deployment, err
 			},
 		}
 
-		if _, err := bkt.Update(ctx, newBktAttrs); err != nil {
-			u.Step(terminal.StatusError, fmt.Sprintf("Error configuring %s to be uniformly accessible", attrs.Name))
+		err = policy.Do(ctx, "update bucket", func() error {
+			_, err := bkt.Update(ctx, newBktAttrs)
+			return err
+		})
+		if err != nil {
+			u.Step(terminal.StatusError, fmt.Sprintf("Error configuring %s to be uniformly accessible", p.config.Bucket))
 			return nil, err
 		}
 
 		u.Step(terminal.StatusOK, fmt.Sprintf("Bucket %s successfully created", p.config.Bucket))
 	} else {
 		u.Step(terminal.StatusOK, fmt.Sprintf("Found existing bucket %s", attrs.Name))
+
+		// labels are only stamped on buckets the plugin creates, so a bucket
+		// someone else made is never adopted
+		if !ownership.For(src, job, p.config.Project).Owns(attrs.Labels) {
+			u.Step(terminal.StatusWarn, fmt.Sprintf(
+				"Bucket %s was not created by this plugin for this app and workspace, destroy will leave it unless force = true",
+				attrs.Name))
+		}
+
+		if mismatch := p.config.BucketConfig.locationMismatch(attrs, p.config.Region); mismatch != "" {
+			u.Step(terminal.StatusWarn, mismatch)
+		}
+
+		update, changes := p.config.BucketConfig.reconcile(attrs, p.config.KMSKey)
+		if len(changes) > 0 {
+			u.Update("Reconciling bucket settings...")
+
+			err := policy.Do(ctx, "update bucket", func() error {
+				_, err := bkt.Update(ctx, update)
+				return err
+			})
+			if err != nil {
+				u.Step(terminal.StatusError, fmt.Sprintf("Error updating settings of bucket %s", p.config.Bucket))
+				return nil, fmt.Errorf("failed to update bucket: %s", explainKMSError(err, kmsHint))
+			}
+
+			u.Step(terminal.StatusOK, fmt.Sprintf("Updated bucket settings: %s", strings.Join(changes, ", ")))
+		}
+	}
+
+	if p.config.BucketConfig != nil && p.config.BucketConfig.Autoclass != nil {
+		u.Update("Configuring Autoclass...")
+
+		gc := p.gcloud(ctx, policy)
+
+		enabled, err := gc.StorageBucket.AutoclassEnabled()
+		if err == nil && enabled != *p.config.BucketConfig.Autoclass {
+			_, err = gc.StorageBucket.SetAutoclass(*p.config.BucketConfig.Autoclass)
+		}
+		if err != nil {
+			u.Step(terminal.StatusError, "Error configuring Autoclass")
+			return nil, fmt.Errorf("failed to configure Autoclass: %s", err.Error())
+		}
 	}
 
 	u.Update("Configuring bucket for website hosting...")
 
+	// an empty CORS list clears any policy that is no longer configured
 	bktAttrsToUpdate := storage.BucketAttrsToUpdate{
 		Website: &storage.BucketWebsite{
 			MainPageSuffix: p.config.IndexPage,
-			NotFoundPage:   p.config.NotFoundPage,
+			NotFoundPage:   p.websiteNotFoundPage(attrs),
 		},
+		CORS: corsPolicy(p.config.CORS),
 	}
 
-	if _, err := bkt.Update(ctx, bktAttrsToUpdate); err != nil {
+	err = policy.Do(ctx, "update bucket", func() error {
+		_, err := bkt.Update(ctx, bktAttrsToUpdate)
+		return err
+	})
+	if err != nil {
 		u.Step(terminal.StatusError, fmt.Sprintf("Error configuring %s to host static content", p.config.Bucket))
 		return nil, err
 	}
 
-	// set all objects to be publicly readable
-	public, err := areObjectsPublic(ctx, client, p.config.Bucket)
-	if err != nil {
-		u.Step(terminal.StatusError, "Error accessing bucket's IAM policy")
-		return nil, err
-	}
+	if p.isPublic() {
+		if attrs != nil && attrs.PublicAccessPrevention == storage.PublicAccessPreventionEnforced {
+			u.Step(terminal.StatusError, fmt.Sprintf("Public access prevention is enforced on %s", p.config.Bucket))
+			return nil, fmt.Errorf("cannot make objects in %s public because public access prevention is enforced, %s",
+				p.config.Bucket, privateModeHint)
+		}
 
-	if !public {
-		if _, err := setPublicIAM(ctx, client, p.config.Bucket); err != nil {
-			u.Step(terminal.StatusError, fmt.Sprintf("Error configuring %s objects to be publicly accessible", p.config.Bucket))
+		// set all objects to be publicly readable
+		var public bool
+		err = policy.Do(ctx, "get bucket IAM policy", func() (err error) {
+			public, err = areObjectsPublic(ctx, client, p.config.Bucket)
+			return err
+		})
+		if err != nil {
+			u.Step(terminal.StatusError, "Error accessing bucket's IAM policy")
 			return nil, err
 		}
+
+		if !public {
+			err := policy.Do(ctx, "set bucket IAM policy", func() error {
+				_, err := setPublicIAM(ctx, client, p.config.Bucket)
+				return err
+			})
+			if err != nil {
+				u.Step(terminal.StatusError, fmt.Sprintf("Error configuring %s objects to be publicly accessible", p.config.Bucket))
+				if isPublicAccessPrevented(err) {
+					return nil, fmt.Errorf("%s, %s", err.Error(), privateModeHint)
+				}
+				return nil, err
+			}
+		}
+
+		u.Step(terminal.StatusOK, fmt.Sprintf("Objects within %s are publicly accessible", p.config.Bucket))
+	} else {
+		// the release grants read access to Cloud CDN alone
+		err = policy.Do(ctx, "set bucket IAM policy", func() error {
+			return removePublicIAM(ctx, client, p.config.Bucket)
+		})
+		if err != nil {
+			u.Step(terminal.StatusError, "Error accessing bucket's IAM policy")
+			return nil, err
+		}
+
+		u.Step(terminal.StatusOK, fmt.Sprintf("Objects within %s are private", p.config.Bucket))
 	}
 
-	u.Step(terminal.StatusOK, fmt.Sprintf("Objects within %s are publicly accessible", p.config.Bucket))
+	u.Update("Comparing static files against bucket contents...")
 
-	u.Update("Uploading static files...")
+	var existing map[string]*storage.ObjectAttrs
+	err = policy.Do(ctx, "list objects", func() (err error) {
+		existing, err = listObjects(ctx, client, p.config.Bucket, prefix)
+		return err
+	})
+	if err != nil {
+		u.Step(terminal.StatusError, fmt.Sprintf("Error listing objects in %s", p.config.Bucket))
+		return nil, err
+	}
 
-	fileErrors := []string{}
-	uploadFiles(ctx, client, p.config.Bucket, p.config.Directory, "", &fileErrors)
+	if p.config.Versioned {
+		u.Update(fmt.Sprintf("Uploading %d static files to %s...", len(files), prefix))
+	} else {
+		u.Update(fmt.Sprintf("Uploading %d static files...", len(files)))
+	}
+
+	up := p.newUploader(client, policy, prefix)
+	up.existing = existing
+	up.kmsHint = kmsHint
+	stats, fileErrors := up.Run(ctx, files)
+	uploadedAt := time.Now().UTC()
+
+	if ctx.Err() != nil {
+		u.Step(terminal.StatusError, "Upload of static files was cancelled")
+		return nil, ctx.Err()
+	}
 
 	if len(fileErrors) > 0 {
-		u.Step(terminal.StatusWarn, "Some static files failed to upload")
+		sortFailures(fileErrors)
+
+		if p.exceedsFailurePolicy(len(fileErrors)) {
+			u.Step(terminal.StatusError, fmt.Sprintf("%d of %d static files failed to upload", len(fileErrors), len(files)))
+			u.Close()
+			ui.Table(failureTable(fileErrors))
+			return nil, fmt.Errorf("%d static files failed to upload, exceeding the configured failure policy", len(fileErrors))
+		}
+
+		u.Step(terminal.StatusWarn, fmt.Sprintf("%d of %d static files failed to upload", len(fileErrors), len(files)))
+		u.Close()
+		ui.Table(failureTable(fileErrors))
+		u = ui.Status()
+		defer u.Close()
+	}
+
+	u.Step(terminal.StatusOK, fmt.Sprintf("Upload of static files complete: %d uploaded, %d unchanged", stats.Uploaded, stats.Unchanged))
+
+	if stats.Compressed > 0 {
+		u.Step(terminal.StatusOK, fmt.Sprintf("Compressed %d files with gzip, saving %s", stats.Compressed, formatBytes(stats.BytesSaved)))
 	}
 
-	u.Step(terminal.StatusOK, "Upload of static files complete")
+	manifestName := manifestObject(prefix, deploymentID)
+	if err := writeManifest(ctx, client, policy, p.config.Bucket, manifestName, up.manifest, p.config.KMSKey); err != nil {
+		u.Step(terminal.StatusError, "Error recording deployment manifest")
+		return nil, fmt.Errorf("failed to write manifest: %s", explainKMSError(err, kmsHint))
+	}
+
+	if p.config.Prune {
+		// only prune once every upload has landed, otherwise visitors could be
+		// served pages whose assets were removed
+		if len(fileErrors) > 0 {
+			u.Step(terminal.StatusWarn, "Skipped pruning stale objects because some uploads failed")
+		} else {
+			stale := staleObjects(existing, files, prefix, p.protectedPrefixes())
+
+			u.Update(fmt.Sprintf("Pruning %d stale objects...", len(stale)))
+
+			deleted, pruneErrors := deleteObjects(ctx, client, policy, p.config.Bucket, liveRefs(stale), p.concurrency(), nil)
+			if ctx.Err() != nil {
+				u.Step(terminal.StatusError, "Pruning of stale objects was cancelled")
+				return nil, ctx.Err()
+			}
+
+			if len(pruneErrors) > 0 {
+				u.Step(terminal.StatusWarn, fmt.Sprintf("Failed to prune %d stale objects", len(pruneErrors)))
+				u.Close()
+				ui.Table(failureTable(pruneErrors))
+				u = ui.Status()
+				defer u.Close()
+			}
+
+			u.Step(terminal.StatusOK, fmt.Sprintf("Pruned %d stale objects", deleted))
+		}
+	}
 
 	return &Deployment{
 		Bucket:  p.config.Bucket,
 		Region:  p.config.Region,
 		Project: p.config.Project,
+		Id:      deploymentID,
+		Prefix:  prefix,
+
+		ObjectCount:    int64(len(up.manifest)),
+		TotalBytes:     stats.TotalBytes,
+		ManifestHash:   manifestHash(up.manifest),
+		UploadedAt:     uploadedAt.Format(time.RFC3339),
+		FailedFiles:    int64(len(fileErrors)),
+		WebsiteUrl:     websiteURL(p.config.Bucket, prefix, p.config.IndexPage, p.isPublic()),
+		Private:        !p.isPublic(),
+		Failures:       capFailures(fileErrors),
+		ManifestObject: manifestName,
+		NotFoundPage:   releasedNotFoundPage(prefix, p.config.NotFoundPage),
+
+		CredentialsFile:           p.config.CredentialsFile,
+		ImpersonateServiceAccount: p.config.ImpersonateServiceAccount,
+		GcloudAccount:             p.config.GCloudAccount,
 	}, nil
 }
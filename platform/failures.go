@@ -0,0 +1,34 @@
+package platform
+
+import (
+	"sort"
+
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+)
+
+// most failures kept in the Deployment output, the rest are only counted
+const maxRecordedFailures = 100
+
+func sortFailures(failures []*FailedFile) {
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Path < failures[j].Path })
+}
+
+func capFailures(failures []*FailedFile) []*FailedFile {
+	if len(failures) > maxRecordedFailures {
+		return failures[:maxRecordedFailures]
+	}
+
+	return failures
+}
+
+func failureTable(failures []*FailedFile) *terminal.Table {
+	tbl := terminal.NewTable("File", "Reason")
+	for _, failure := range failures {
+		tbl.Rich(
+			[]string{failure.Path, failure.Reason},
+			[]string{"", terminal.Red},
+		)
+	}
+
+	return tbl
+}
@@ -0,0 +1,65 @@
+package platform
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// globPattern matches slash separated object names. "*" and "?" never cross a
+// "/", "**" matches any number of directories, and a pattern without a "/"
+// is matched against the base name so that "*.html" applies at every depth.
+// As in gitignore, a leading "/" anchors a pattern to the root.
+type globPattern struct {
+	raw      string
+	re       *regexp.Regexp
+	baseOnly bool
+}
+
+func compileGlob(pattern string) (*globPattern, error) {
+	baseOnly := !strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					sb.WriteString("(?:.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &globPattern{
+		raw:      pattern,
+		re:       re,
+		baseOnly: baseOnly,
+	}, nil
+}
+
+func (g *globPattern) Match(name string) bool {
+	if g.baseOnly {
+		return g.re.MatchString(path.Base(name))
+	}
+
+	return g.re.MatchString(name)
+}
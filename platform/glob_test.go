@@ -0,0 +1,47 @@
+package platform
+
+import "testing"
+
+func TestCompileGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*.html", "index.html", true},
+		{"*.html", "docs/guide/index.html", true},
+		{"*.html", "index.htm", false},
+		{"foo", "foo", true},
+		{"foo", "a/foo", true},
+		{"/foo", "foo", true},
+		{"/foo", "a/foo", false},
+		{"/*.html", "index.html", true},
+		{"/*.html", "docs/index.html", false},
+		{"static/*.js", "static/app.js", true},
+		{"static/*.js", "static/js/app.js", false},
+		{"static/*.js", "a/static/app.js", false},
+		{"static/**", "static/js/app.js", true},
+		{"static/**", "assets/static/app.js", false},
+		{"**/foo", "foo", true},
+		{"**/foo", "a/b/foo", true},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/c", false},
+		{"?.txt", "a.txt", true},
+		{"?.txt", "ab.txt", false},
+		{"dir/?", "dir/a", true},
+		{"dir/?", "dir/a/b", false},
+		{"a.b", "axb", false},
+	}
+
+	for _, c := range cases {
+		glob, err := compileGlob(c.pattern)
+		if err != nil {
+			t.Fatalf("compileGlob(%q): %s", c.pattern, err)
+		}
+
+		if got := glob.Match(c.name); got != c.match {
+			t.Errorf("compileGlob(%q).Match(%q) = %t, want %t", c.pattern, c.name, got, c.match)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package platform
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// name of the gitignore style file read from the root of the build directory
+const ignoreFile = ".cdnignore"
+
+// files that are never worth publishing, applied before exclude and the
+// .cdnignore file so either can re-include them with a "!" pattern
+var defaultExcludes = []string{".DS_Store", "Thumbs.db", ".git/", ".env", ".env.*"}
+
+// ignoreRule is a single gitignore style pattern
+type ignoreRule struct {
+	glob    *globPattern
+	negate  bool
+	dirOnly bool
+}
+
+// fileFilter decides which files in the build directory are uploaded. Files
+// must match one of the include globs, when any are set, and must not be
+// ignored by the exclude patterns or the .cdnignore file.
+type fileFilter struct {
+	include []*globPattern
+	ignore  []ignoreRule
+}
+
+func newFileFilter(buildDir string, include, exclude []string) (*fileFilter, error) {
+	f := &fileFilter{}
+
+	for _, pattern := range include {
+		glob, err := compileGlob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include glob %q: %s", pattern, err.Error())
+		}
+		f.include = append(f.include, glob)
+	}
+
+	rules := append([]string{ignoreFile}, defaultExcludes...)
+	if err := f.addIgnoreRules(append(rules, exclude...)); err != nil {
+		return nil, err
+	}
+
+	lines, err := readIgnoreFile(filepath.Join(buildDir, ignoreFile))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.addIgnoreRules(lines); err != nil {
+		return nil, fmt.Errorf("%s: %s", ignoreFile, err.Error())
+	}
+
+	return f, nil
+}
+
+// readIgnoreFile returns the patterns in a gitignore style file, or nothing if
+// the file doesn't exist
+func readIgnoreFile(fpath string) ([]string, error) {
+	f, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines, scanner.Err()
+}
+
+func (f *fileFilter) addIgnoreRules(lines []string) error {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{}
+
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+
+		// a trailing "/" only restricts the rule to directories, it doesn't
+		// anchor it the way a leading or inner one does
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+
+		glob, err := compileGlob(line)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %s", line, err.Error())
+		}
+		rule.glob = glob
+
+		f.ignore = append(f.ignore, rule)
+	}
+
+	return nil
+}
+
+// ignored applies the rules in order so later ones override earlier ones, as
+// gitignore does
+func (f *fileFilter) ignored(name string, isDir bool) bool {
+	ignored := false
+	for _, rule := range f.ignore {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if rule.glob.Match(name) {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
+
+// Allows reports whether the file with the slash separated name should be
+// uploaded. As with gitignore, a file inside an ignored directory can't be
+// re-included.
+func (f *fileFilter) Allows(name string) bool {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		if f.ignored(strings.Join(parts[:i], "/"), true) {
+			return false
+		}
+	}
+
+	if f.ignored(name, false) {
+		return false
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+
+	for _, glob := range f.include {
+		if glob.Match(name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,69 @@
+package platform
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileFilterAllows(t *testing.T) {
+	cases := []struct {
+		desc      string
+		include   []string
+		exclude   []string
+		cdnignore []string
+		name      string
+		allowed   bool
+	}{
+		{desc: "plain file", name: "index.html", allowed: true},
+		{desc: "default .env", name: ".env", allowed: false},
+		{desc: "default .env variant", name: "config/.env.production", allowed: false},
+		{desc: "default .git directory", name: ".git/config", allowed: false},
+		{desc: "default .DS_Store", name: "img/.DS_Store", allowed: false},
+		{desc: "ignore file itself", name: ".cdnignore", allowed: false},
+
+		{desc: "exclude keeps defaults", exclude: []string{"*.map"}, name: ".env", allowed: false},
+		{desc: "exclude glob", exclude: []string{"*.map"}, name: "js/app.js.map", allowed: false},
+		{desc: "exclude leaves others", exclude: []string{"*.map"}, name: "js/app.js", allowed: true},
+		{desc: "re-include default", exclude: []string{"!.env.example"}, name: ".env.example", allowed: true},
+		{desc: "re-include is specific", exclude: []string{"!.env.example"}, name: ".env.local", allowed: false},
+
+		{desc: "anchored at root", cdnignore: []string{"/foo"}, name: "foo", allowed: false},
+		{desc: "anchored not nested", cdnignore: []string{"/foo"}, name: "a/foo", allowed: true},
+		{desc: "unanchored nested", cdnignore: []string{"foo"}, name: "a/foo", allowed: false},
+		{desc: "inner slash anchors", cdnignore: []string{"a/foo"}, name: "a/foo", allowed: false},
+		{desc: "inner slash not nested", cdnignore: []string{"a/foo"}, name: "b/a/foo", allowed: true},
+		{desc: "dir only matches dir", cdnignore: []string{"foo/"}, name: "foo/bar.txt", allowed: false},
+		{desc: "dir only matches nested dir", cdnignore: []string{"foo/"}, name: "a/foo/bar.txt", allowed: false},
+		{desc: "dir only skips file", cdnignore: []string{"foo/"}, name: "foo", allowed: true},
+		{desc: "anchored dir only", cdnignore: []string{"/foo/"}, name: "a/foo/bar.txt", allowed: true},
+		{desc: "comment", cdnignore: []string{"# *.html"}, name: "index.html", allowed: true},
+		{desc: "escaped bang", cdnignore: []string{`\!important`}, name: "!important", allowed: false},
+		{desc: "negation", cdnignore: []string{"*.txt", "!keep.txt"}, name: "keep.txt", allowed: true},
+		{desc: "no re-include inside ignored dir", cdnignore: []string{"logs/", "!logs/keep.txt"}, name: "logs/keep.txt", allowed: false},
+
+		{desc: "include match", include: []string{"static/**"}, name: "static/app.js", allowed: true},
+		{desc: "include miss", include: []string{"static/**"}, name: "index.html", allowed: false},
+		{desc: "exclude beats include", include: []string{"*.js"}, exclude: []string{"vendor/"}, name: "vendor/lib.js", allowed: false},
+	}
+
+	for _, c := range cases {
+		dir := t.TempDir()
+		if c.cdnignore != nil {
+			data := []byte(strings.Join(c.cdnignore, "\n") + "\n")
+			if err := os.WriteFile(filepath.Join(dir, ignoreFile), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		f, err := newFileFilter(dir, c.include, c.exclude)
+		if err != nil {
+			t.Fatalf("%s: %s", c.desc, err)
+		}
+
+		if got := f.Allows(c.name); got != c.allowed {
+			t.Errorf("%s: Allows(%q) = %t, want %t", c.desc, c.name, got, c.allowed)
+		}
+	}
+}
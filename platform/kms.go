@@ -0,0 +1,97 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/gcloud"
+)
+
+var kmsKeyPattern = regexp.MustCompile(`^projects/([^/]+)/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// roles that let the Cloud Storage service agent encrypt and decrypt with a key
+const kmsRole = "roles/cloudkms.cryptoKeyEncrypterDecrypter"
+
+func validateKMSKey(key string) error {
+	if key != "" && !kmsKeyPattern.MatchString(key) {
+		return fmt.Errorf("kms_key must look like projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY")
+	}
+
+	return nil
+}
+
+// checkKMSAccess looks for a grant of key to the project's Cloud Storage
+// service agent, since the bucket and every upload fail without one. Only
+// direct grants on the key or its project can be seen, and reading them needs
+// getIamPolicy permissions a least-privilege identity may not have, so an
+// error here only means access couldn't be confirmed. The hint explains how to
+// grant access, for attaching to whatever fails later.
+func checkKMSAccess(
+	c context.Context,
+	client *storage.Client,
+	gc *gcloud.GCloud,
+	project string,
+	key string,
+) (string, error) {
+	agent, err := client.ServiceAccount(c, project)
+	if err != nil {
+		hint := kmsHint(key, "service-PROJECT_NUMBER@gs-project-accounts.iam.gserviceaccount.com")
+		return hint, fmt.Errorf("failed to look up the Cloud Storage service agent: %s", err.Error())
+	}
+	member := "serviceAccount:" + agent
+	hint := kmsHint(key, agent)
+
+	members, err := gc.KMS.KeyMembers(key, kmsRole)
+	if err != nil {
+		return hint, fmt.Errorf("failed to read the IAM policy of %s: %s", key, err.Error())
+	}
+
+	if includesMember(members, member) {
+		return hint, nil
+	}
+
+	// grants on the key's project apply to the key as well
+	keyProject := kmsKeyPattern.FindStringSubmatch(key)[1]
+	members, err = gc.KMS.ProjectMembers(keyProject, kmsRole)
+	if err == nil && includesMember(members, member) {
+		return hint, nil
+	}
+
+	return hint, fmt.Errorf("no direct grant of %s to %s was found on the key or its project", kmsRole, agent)
+}
+
+func kmsHint(key, agent string) string {
+	return fmt.Sprintf("grant the Cloud Storage service agent access with: "+
+		"gcloud kms keys add-iam-policy-binding %s --member=serviceAccount:%s --role=%s",
+		key, agent, kmsRole)
+}
+
+// explainKMSError adds the grant hint to failures caused by the KMS key, which
+// otherwise surface as a bare 403
+func explainKMSError(err error, hint string) string {
+	msg := err.Error()
+	if hint != "" && strings.Contains(strings.ToLower(msg), "kms") {
+		return msg + " (" + hint + ")"
+	}
+
+	return msg
+}
+
+func includesMember(members []string, member string) bool {
+	for _, m := range members {
+		if strings.EqualFold(m, member) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// encryptedWith reports whether an object is encrypted with key. Objects record
+// the key version they were written with, so compare on the key's name.
+func encryptedWith(attrs *storage.ObjectAttrs, key string) bool {
+	return attrs.KMSKeyName == key || strings.HasPrefix(attrs.KMSKeyName, key+"/cryptoKeyVersions/")
+}
@@ -0,0 +1,74 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+
+	"cloud.google.com/go/storage"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/retry"
+)
+
+// manifests are kept in the bucket rather than the Deployment, which would
+// otherwise grow by an entry for every uploaded file. Deployments that share
+// the bucket root each get their own, so older ones can still be checked.
+//
+// In public mode every object in the bucket is readable, and the manifest sits
+// under the website root, so anyone can fetch it through the CDN and get the
+// full list of objects, which public buckets otherwise don't give out. It only
+// names files that are already public, but private = true is the way to keep
+// it from being read.
+const manifestDir = ".waypoint/manifests/"
+
+func manifestObject(prefix, id string) string {
+	return prefix + manifestDir + id + ".json"
+}
+
+// writeManifest stores the object name to hex MD5 manifest of a deployment
+func writeManifest(
+	c context.Context,
+	client *storage.Client,
+	policy *retry.Policy,
+	bucketName string,
+	name string,
+	manifest map[string]string,
+	kmsKey string,
+) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	return policy.Do(c, "write manifest", func() error {
+		wc := client.Bucket(bucketName).Object(name).NewWriter(c)
+		wc.ContentType = "application/json"
+		wc.CacheControl = "no-store"
+		wc.KMSKeyName = kmsKey
+
+		if _, err := wc.Write(data); err != nil {
+			wc.Close()
+			return err
+		}
+
+		return wc.Close()
+	})
+}
+
+func readManifest(
+	c context.Context,
+	client *storage.Client,
+	bucketName string,
+	name string,
+) (map[string]string, error) {
+	r, err := client.Bucket(bucketName).Object(name).NewReader(c)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	manifest := map[string]string{}
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
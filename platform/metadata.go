@@ -0,0 +1,101 @@
+package platform
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/storage"
+)
+
+// MetadataRule sets headers on every uploaded object whose name matches Glob,
+// for example:
+//
+//	metadata "static/**" {
+//	  cache_control = "public, max-age=31536000, immutable"
+//	}
+type MetadataRule struct {
+	Glob               string            `hcl:",label"`
+	CacheControl       string            `hcl:"cache_control,optional"`
+	ContentDisposition string            `hcl:"content_disposition,optional"`
+	ContentLanguage    string            `hcl:"content_language,optional"`
+	Custom             map[string]string `hcl:"custom,optional"`
+
+	glob *globPattern
+}
+
+// objectHeaders are the attributes the uploader writes alongside each object
+type objectHeaders struct {
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	ContentLanguage    string
+	Metadata           map[string]string
+}
+
+func compileMetadataRules(rules []*MetadataRule) error {
+	for _, rule := range rules {
+		glob, err := compileGlob(rule.Glob)
+		if err != nil {
+			return fmt.Errorf("invalid metadata glob %q: %s", rule.Glob, err.Error())
+		}
+		rule.glob = glob
+	}
+
+	return nil
+}
+
+// applyMetadataRules layers every matching rule over h in order, so later
+// rules take precedence over earlier ones
+func applyMetadataRules(h *objectHeaders, name string, rules []*MetadataRule) {
+	for _, rule := range rules {
+		if rule.glob == nil || !rule.glob.Match(name) {
+			continue
+		}
+
+		if rule.CacheControl != "" {
+			h.CacheControl = rule.CacheControl
+		}
+		if rule.ContentDisposition != "" {
+			h.ContentDisposition = rule.ContentDisposition
+		}
+		if rule.ContentLanguage != "" {
+			h.ContentLanguage = rule.ContentLanguage
+		}
+		for k, v := range rule.Custom {
+			if h.Metadata == nil {
+				h.Metadata = map[string]string{}
+			}
+			h.Metadata[k] = v
+		}
+	}
+}
+
+// headersMatch reports whether an existing object already carries the headers
+// the uploader would write
+func headersMatch(attrs *storage.ObjectAttrs, h objectHeaders) bool {
+	if attrs.ContentType != h.ContentType ||
+		attrs.ContentEncoding != h.ContentEncoding ||
+		attrs.CacheControl != h.CacheControl ||
+		attrs.ContentDisposition != h.ContentDisposition ||
+		attrs.ContentLanguage != h.ContentLanguage ||
+		len(attrs.Metadata) != len(h.Metadata) {
+		return false
+	}
+
+	for k, v := range h.Metadata {
+		if attrs.Metadata[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (h objectHeaders) apply(wc *storage.Writer) {
+	wc.ContentType = h.ContentType
+	wc.ContentEncoding = h.ContentEncoding
+	wc.CacheControl = h.CacheControl
+	wc.ContentDisposition = h.ContentDisposition
+	wc.ContentLanguage = h.ContentLanguage
+	wc.Metadata = h.Metadata
+}
@@ -0,0 +1,105 @@
+package platform
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// content types for the extensions commonly found in static site builds,
+// checked before falling back to sniffing the file's contents
+var mimeTypes = map[string]string{
+	".html":        "text/html; charset=utf-8",
+	".htm":         "text/html; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".js":          "application/javascript; charset=utf-8",
+	".mjs":         "application/javascript; charset=utf-8",
+	".cjs":         "application/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".xml":         "application/xml",
+	".rss":         "application/rss+xml",
+	".atom":        "application/atom+xml",
+	".txt":         "text/plain; charset=utf-8",
+	".md":          "text/markdown; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".ics":         "text/calendar; charset=utf-8",
+	".wasm":        "application/wasm",
+	".pdf":         "application/pdf",
+	".zip":         "application/zip",
+	".gz":          "application/gzip",
+	".svg":         "image/svg+xml",
+	".png":         "image/png",
+	".jpg":         "image/jpeg",
+	".jpeg":        "image/jpeg",
+	".gif":         "image/gif",
+	".webp":        "image/webp",
+	".avif":        "image/avif",
+	".ico":         "image/x-icon",
+	".bmp":         "image/bmp",
+	".tif":         "image/tiff",
+	".tiff":        "image/tiff",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".ttf":         "font/ttf",
+	".otf":         "font/otf",
+	".eot":         "application/vnd.ms-fontobject",
+	".mp3":         "audio/mpeg",
+	".ogg":         "audio/ogg",
+	".wav":         "audio/wav",
+	".mp4":         "video/mp4",
+	".webm":        "video/webm",
+}
+
+// detectMimeType picks a content type for fname, preferring the configured
+// overrides, then the extension table, and finally sniffing the contents of r
+func detectMimeType(fname string, r io.Reader, overrides map[string]string) (string, error) {
+	ext := strings.ToLower(path.Ext(fname))
+
+	if cType, ok := overrides[ext]; ok {
+		return cType, nil
+	}
+
+	if cType, ok := mimeTypes[ext]; ok {
+		return cType, nil
+	}
+
+	m, err := mimetype.DetectReader(r)
+	if err != nil {
+		return "", err
+	}
+
+	return m.String(), nil
+}
+
+// normalizeExtension lower-cases ext and makes sure it has a leading dot so
+// that both "woff2" and ".WOFF2" match
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+
+	return ext
+}
+
+func normalizeContentTypes(overrides map[string]string) map[string]string {
+	normalized := make(map[string]string, len(overrides))
+	for ext, cType := range overrides {
+		normalized[normalizeExtension(ext)] = cType
+	}
+
+	return normalized
+}
+
+func normalizeExtensions(exts []string) map[string]bool {
+	normalized := make(map[string]bool, len(exts))
+	for _, ext := range exts {
+		normalized[normalizeExtension(ext)] = true
+	}
+
+	return normalized
+}
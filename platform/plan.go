@@ -0,0 +1,246 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/ownership"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/retry"
+)
+
+// plan works out everything Deploy would change and prints it, without
+// modifying the bucket, its configuration or any objects
+func (p *Platform) plan(
+	ctx context.Context,
+	ui terminal.UI,
+	client *storage.Client,
+	policy *retry.Policy,
+	files []localFile,
+	skipped int,
+	findings []finding,
+	prefix string,
+	owner ownership.Owner,
+) error {
+	u := ui.Status()
+	defer u.Close()
+	u.Step("", "---Planning Cloud Storage Deployment (dry run)---")
+
+	u.Update("Inspecting bucket...")
+
+	attrs, err := client.Bucket(p.config.Bucket).Attrs(ctx)
+	bucketExists := err == nil
+	if err != nil && err != storage.ErrBucketNotExist {
+		u.Step(terminal.StatusError, fmt.Sprintf("Error inspecting bucket %s", p.config.Bucket))
+		return err
+	}
+
+	resources := terminal.NewTable("Resource", "Change", "Details")
+
+	if !bucketExists {
+		create := p.config.BucketConfig.createAttrs(p.config.Region, p.config.KMSKey, owner.Labels())
+		resources.Rich(
+			[]string{"bucket", actionCreate, fmt.Sprintf("%s in %s", p.config.Bucket, create.Location)},
+			[]string{"", terminal.Green, ""},
+		)
+
+		labels := []string{}
+		for k, v := range create.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+
+		resources.Rich(
+			[]string{"bucket", actionCreate, "labels " + strings.Join(labels, ", ")},
+			[]string{"", terminal.Green, ""},
+		)
+		resources.Rich(
+			[]string{"bucket", actionUpdate, "enable uniform bucket-level access"},
+			[]string{"", terminal.Yellow, ""},
+		)
+	} else {
+		if mismatch := p.config.BucketConfig.locationMismatch(attrs, p.config.Region); mismatch != "" {
+			resources.Rich(
+				[]string{"bucket", "conflict", mismatch},
+				[]string{"", terminal.Red, ""},
+			)
+		}
+
+		_, changes := p.config.BucketConfig.reconcile(attrs, p.config.KMSKey)
+		for _, change := range changes {
+			resources.Rich(
+				[]string{"bucket", actionUpdate, change},
+				[]string{"", terminal.Yellow, ""},
+			)
+		}
+	}
+
+	// new buckets start with Autoclass off
+	if p.config.BucketConfig != nil && p.config.BucketConfig.Autoclass != nil {
+		enabled := false
+		if bucketExists {
+			enabled, err = p.gcloud(ctx, policy).StorageBucket.AutoclassEnabled()
+			if err != nil {
+				u.Step(terminal.StatusError, "Error checking Autoclass")
+				return fmt.Errorf("failed to check Autoclass: %s", err.Error())
+			}
+		}
+
+		if enabled != *p.config.BucketConfig.Autoclass {
+			resources.Rich(
+				[]string{"autoclass", actionUpdate, fmt.Sprintf("enabled=%t", *p.config.BucketConfig.Autoclass)},
+				[]string{"", terminal.Yellow, ""},
+			)
+		}
+	}
+
+	notFoundPage := p.websiteNotFoundPage(attrs)
+	if !bucketExists || attrs.Website == nil ||
+		attrs.Website.MainPageSuffix != p.config.IndexPage ||
+		attrs.Website.NotFoundPage != notFoundPage {
+		resources.Rich(
+			[]string{"website", actionUpdate, fmt.Sprintf("index=%q not_found=%q", p.config.IndexPage, notFoundPage)},
+			[]string{"", terminal.Yellow, ""},
+		)
+	}
+
+	cors := corsPolicy(p.config.CORS)
+	if !bucketExists && len(cors) > 0 || bucketExists && !corsMatches(attrs.CORS, cors) {
+		resources.Rich(
+			[]string{"cors", actionUpdate, fmt.Sprintf("%d rules", len(cors))},
+			[]string{"", terminal.Yellow, ""},
+		)
+	}
+
+	public := false
+	if bucketExists {
+		public, err = areObjectsPublic(ctx, client, p.config.Bucket)
+		if err != nil {
+			u.Step(terminal.StatusError, "Error accessing bucket's IAM policy")
+			return err
+		}
+	}
+
+	if p.isPublic() && !public {
+		resources.Rich(
+			[]string{"iam", actionUpdate, "grant allUsers roles/storage.objectViewer"},
+			[]string{"", terminal.Yellow, ""},
+		)
+
+		if bucketExists && attrs.PublicAccessPrevention == storage.PublicAccessPreventionEnforced {
+			resources.Rich(
+				[]string{"iam", "conflict", "public access prevention is enforced, " + privateModeHint},
+				[]string{"", terminal.Red, ""},
+			)
+		}
+	} else if !p.isPublic() && public {
+		resources.Rich(
+			[]string{"iam", actionUpdate, "revoke allUsers roles/storage.objectViewer"},
+			[]string{"", terminal.Yellow, ""},
+		)
+	}
+
+	u.Update("Comparing static files against bucket contents...")
+
+	existing := map[string]*storage.ObjectAttrs{}
+	if bucketExists {
+		existing, err = listObjects(ctx, client, p.config.Bucket, prefix)
+		if err != nil {
+			u.Step(terminal.StatusError, fmt.Sprintf("Error listing objects in %s", p.config.Bucket))
+			return err
+		}
+	}
+
+	up := p.newUploader(client, policy, prefix)
+	up.existing = existing
+	up.dryRun = true
+
+	stats, fileErrors := up.Run(ctx, files)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	changes := up.changes
+	if p.config.Prune {
+		for _, name := range staleObjects(existing, files, prefix, p.protectedPrefixes()) {
+			changes = append(changes, plannedChange{
+				Name:   name,
+				Action: actionDelete,
+				Size:   existing[name].Size,
+			})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+
+	u.Step(terminal.StatusOK, "Plan complete")
+	u.Close()
+
+	if len(resources.Rows) > 0 {
+		ui.Output("Bucket changes:", terminal.WithHeaderStyle())
+		ui.Table(resources)
+	} else {
+		ui.Output("Bucket %s needs no changes", p.config.Bucket, terminal.WithInfoStyle())
+	}
+
+	if len(changes) > 0 {
+		objects := terminal.NewTable("Object", "Change", "Size")
+		for _, change := range changes {
+			objects.Rich(
+				[]string{change.Name, change.Action, strconv.FormatInt(change.Size, 10)},
+				[]string{"", actionColor(change.Action), ""},
+			)
+		}
+
+		ui.Output("Object changes:", terminal.WithHeaderStyle())
+		ui.Table(objects)
+	}
+
+	var uploadBytes, deleteBytes int64
+	deletes := 0
+	for _, change := range changes {
+		if change.Action == actionDelete {
+			deletes++
+			deleteBytes += change.Size
+		} else {
+			uploadBytes += change.Size
+		}
+	}
+
+	ui.Output(
+		"%d to upload (%s), %d to delete (%s), %d unchanged, %d skipped",
+		stats.Uploaded, formatBytes(uploadBytes),
+		deletes, formatBytes(deleteBytes),
+		stats.Unchanged, skipped,
+		terminal.WithInfoStyle(),
+	)
+
+	if len(findings) > 0 {
+		ui.Output("%d possible secrets would be made public:", len(findings), terminal.WithWarningStyle())
+		ui.Table(findingTable(findings))
+	}
+
+	if len(fileErrors) > 0 {
+		ui.Output("%d files could not be read:", len(fileErrors), terminal.WithWarningStyle())
+		sortFailures(fileErrors)
+		ui.Table(failureTable(fileErrors))
+	}
+
+	return nil
+}
+
+func actionColor(action string) string {
+	switch action {
+	case actionCreate:
+		return terminal.Green
+	case actionUpdate:
+		return terminal.Yellow
+	case actionDelete:
+		return terminal.Red
+	}
+
+	return ""
+}
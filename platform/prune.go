@@ -0,0 +1,187 @@
+package platform
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/retry"
+	"google.golang.org/api/iterator"
+)
+
+// prefixes that are never pruned when protected_prefixes isn't configured
+var defaultProtectedPrefixes = []string{".well-known/"}
+
+func isProtected(name string, protected []string) bool {
+	for _, prefix := range protected {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// staleObjects returns the names of existing objects that have no counterpart
+// in the build directory uploaded under prefix and are not covered by a
+// protected prefix
+func staleObjects(
+	existing map[string]*storage.ObjectAttrs,
+	files []localFile,
+	prefix string,
+	protected []string,
+) []string {
+	local := make(map[string]bool, len(files))
+	for _, file := range files {
+		local[prefix+file.Name] = true
+	}
+
+	stale := []string{}
+	for name := range existing {
+		if !local[name] && !isProtected(name, protected) {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+
+	return stale
+}
+
+// a specific object generation, zero meaning the live version
+type objectRef struct {
+	Name       string
+	Generation int64
+}
+
+// listObjectVersions returns every generation of every object under prefix,
+// including noncurrent versions kept by object versioning
+func listObjectVersions(
+	c context.Context,
+	client *storage.Client,
+	bucketName string,
+	prefix string,
+) ([]objectRef, error) {
+	refs := []objectRef{}
+
+	it := client.Bucket(bucketName).Objects(c, &storage.Query{Prefix: prefix, Versions: true})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		refs = append(refs, objectRef{Name: attrs.Name, Generation: attrs.Generation})
+	}
+
+	return refs, nil
+}
+
+// isBucketEmpty reports whether the bucket holds no objects, counting
+// noncurrent versions
+func isBucketEmpty(c context.Context, client *storage.Client, bucketName string) (bool, error) {
+	it := client.Bucket(bucketName).Objects(c, &storage.Query{Versions: true})
+	_, err := it.Next()
+	if err == iterator.Done {
+		return true, nil
+	}
+
+	return false, err
+}
+
+func liveRefs(names []string) []objectRef {
+	refs := make([]objectRef, 0, len(names))
+	for _, name := range names {
+		refs = append(refs, objectRef{Name: name})
+	}
+
+	return refs
+}
+
+// deleteObjects removes the referenced objects using a bounded pool of workers
+// and returns the number deleted along with any per-object failures. progress,
+// if set, is called after every deletion with the running count.
+func deleteObjects(
+	c context.Context,
+	client *storage.Client,
+	policy *retry.Policy,
+	bucketName string,
+	refs []objectRef,
+	concurrency int,
+	progress func(done, total int),
+) (int, []*FailedFile) {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		done     int
+		deleted  int
+		failures []*FailedFile
+	)
+
+	jobs := make(chan objectRef)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range jobs {
+				obj := client.Bucket(bucketName).Object(ref.Name)
+				if ref.Generation != 0 {
+					obj = obj.Generation(ref.Generation)
+				}
+
+				err := policy.Do(c, "delete "+ref.Name, func() error {
+					return obj.Delete(c)
+				})
+
+				mu.Lock()
+				if err != nil && err != storage.ErrObjectNotExist {
+					failures = append(failures, &FailedFile{Path: ref.Name, Reason: explainDeleteError(err)})
+				} else {
+					deleted++
+				}
+				done++
+				if progress != nil {
+					progress(done, len(refs))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, ref := range refs {
+		select {
+		case <-c.Done():
+			break feed
+		case jobs <- ref:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	sortFailures(failures)
+
+	return deleted, failures
+}
+
+// explainDeleteError adds the fix for retention and hold failures, which
+// otherwise surface as a bare 403
+func explainDeleteError(err error) string {
+	msg := err.Error()
+	lower := strings.ToLower(msg)
+
+	switch {
+	case strings.Contains(lower, "retention"):
+		return msg + " (the object is younger than the bucket's retention period and can't be deleted until it expires)"
+	case strings.Contains(lower, "temporary hold"):
+		return msg + " (release it with: gcloud storage objects update --no-temporary-hold)"
+	case strings.Contains(lower, "event-based hold") || strings.Contains(lower, "event based hold"):
+		return msg + " (release it with: gcloud storage objects update --no-event-based-hold)"
+	}
+
+	return msg
+}
@@ -0,0 +1,221 @@
+package platform
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+)
+
+// how the preflight scan reacts to findings
+const (
+	scanWarn  = "warn"
+	scanBlock = "block"
+	scanOff   = "off"
+)
+
+// files larger than this are only checked by name
+const maxScanSize = 10 << 20
+
+// a likely secret in the build directory
+type finding struct {
+	Path   string
+	Line   int
+	Kind   string
+	Detail string
+}
+
+var (
+	privateKeyPattern = regexp.MustCompile(`-----BEGIN ((RSA|EC|DSA|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----`)
+
+	serviceAccountPattern = regexp.MustCompile(`"type"\s*:\s*"service_account"`)
+
+	// well known credential formats that are never meant to be public
+	tokenPatterns = []struct {
+		kind    string
+		pattern *regexp.Regexp
+	}{
+		{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+		{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[0-9A-Za-z]{36,}\b`)},
+		{"Slack token", regexp.MustCompile(`\bxox[abprs]-[0-9A-Za-z-]{10,}\b`)},
+		{"Stripe secret key", regexp.MustCompile(`\b[sr]k_live_[0-9A-Za-z]{24,}\b`)},
+		{"Google OAuth client secret", regexp.MustCompile(`\bGOCSPX-[0-9A-Za-z_-]{28}\b`)},
+	}
+
+	// long quoted strings in scripts, candidates for the entropy check
+	quotedTokenPattern = regexp.MustCompile("[\"'`]([A-Za-z0-9+/_-]{32,}={0,2})[\"'`]")
+
+	scriptExtensions = map[string]bool{".js": true, ".mjs": true, ".cjs": true}
+)
+
+// scanFiles checks the files about to be made public for private keys,
+// credentials and dotfiles that should never leave the build machine
+func scanFiles(files []localFile) ([]finding, error) {
+	findings := []finding{}
+
+	for _, file := range files {
+		findings = append(findings, scanName(file.Name)...)
+
+		if file.Size > maxScanSize {
+			continue
+		}
+
+		data, err := os.ReadFile(file.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		findings = append(findings, scanContent(file.Name, data)...)
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Path < findings[j].Path })
+
+	return findings, nil
+}
+
+func scanName(name string) []finding {
+	base := path.Base(name)
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".git" {
+			return []finding{{Path: name, Kind: "git metadata", Detail: "file inside a .git directory"}}
+		}
+	}
+
+	if base == ".env" || strings.HasPrefix(base, ".env.") {
+		return []finding{{Path: name, Kind: "environment file", Detail: "dotenv files usually hold secrets"}}
+	}
+
+	switch path.Ext(base) {
+	case ".pem", ".key", ".p12", ".pfx":
+		return []finding{{Path: name, Kind: "key file", Detail: "file extension is used for keys and certificates"}}
+	}
+
+	return nil
+}
+
+func scanContent(name string, data []byte) []finding {
+	findings := []finding{}
+
+	if loc := privateKeyPattern.FindIndex(data); loc != nil {
+		findings = append(findings, finding{
+			Path: name, Line: lineAt(data, loc[0]), Kind: "private key",
+			Detail: "PEM encoded private key",
+		})
+	}
+
+	if path.Ext(name) == ".json" && serviceAccountPattern.Match(data) && bytes.Contains(data, []byte(`"private_key"`)) {
+		findings = append(findings, finding{
+			Path: name, Kind: "service account key",
+			Detail: "Google Cloud service account JSON key",
+		})
+	}
+
+	for _, token := range tokenPatterns {
+		if loc := token.pattern.FindIndex(data); loc != nil {
+			findings = append(findings, finding{
+				Path: name, Line: lineAt(data, loc[0]), Kind: token.kind,
+				Detail: redact(string(data[loc[0]:loc[1]])),
+			})
+		}
+	}
+
+	if scriptExtensions[path.Ext(name)] {
+		for _, loc := range quotedTokenPattern.FindAllSubmatchIndex(data, -1) {
+			token := string(data[loc[2]:loc[3]])
+
+			// subresource integrity hashes are expected. Inline data: URIs never
+			// get here, their ':' and ',' keep them from matching as one token.
+			if isIntegrityHash(token) {
+				continue
+			}
+
+			if looksLikeSecret(token) {
+				findings = append(findings, finding{
+					Path: name, Line: lineAt(data, loc[2]), Kind: "high entropy string",
+					Detail: redact(token),
+				})
+			}
+		}
+	}
+
+	return findings
+}
+
+func isIntegrityHash(token string) bool {
+	for _, algo := range []string{"sha256-", "sha384-", "sha512-"} {
+		if strings.HasPrefix(token, algo) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// looksLikeSecret flags random looking tokens that mix letters and digits,
+// which leaves hex hashes and repetitive identifiers alone. A token can't have
+// more entropy than log2 of its length, or of the 64 character base64url
+// alphabet once it's longer than that, so the bar scales with both. Random
+// tokens land above 0.8 of the limit at every length.
+func looksLikeSecret(token string) bool {
+	hasDigit := strings.IndexAny(token, "0123456789") >= 0
+	hasUpper := strings.IndexAny(token, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") >= 0
+	hasLower := strings.IndexAny(token, "abcdefghijklmnopqrstuvwxyz") >= 0
+
+	limit := math.Log2(math.Min(float64(len(token)), 64))
+
+	return hasDigit && hasUpper && hasLower && shannonEntropy(token) >= 0.8*limit
+}
+
+// shannonEntropy is the average number of bits per character in s
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+
+	entropy := 0.0
+	n := float64(len(s))
+	for _, c := range counts {
+		p := float64(c) / n
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
+
+func lineAt(data []byte, offset int) int {
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// redact keeps enough of a secret to find it without printing it in full
+func redact(s string) string {
+	if len(s) <= 8 {
+		return "****"
+	}
+
+	return s[:4] + "****" + s[len(s)-4:]
+}
+
+func findingTable(findings []finding) *terminal.Table {
+	tbl := terminal.NewTable("File", "Line", "Finding", "Detail")
+	for _, f := range findings {
+		line := ""
+		if f.Line > 0 {
+			line = strconv.Itoa(f.Line)
+		}
+
+		tbl.Rich(
+			[]string{f.Path, line, f.Kind, f.Detail},
+			[]string{"", "", terminal.Yellow, ""},
+		)
+	}
+
+	return tbl
+}
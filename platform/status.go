@@ -0,0 +1,273 @@
+package platform
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/waypoint-plugin-sdk/component"
+	sdk "github.com/hashicorp/waypoint-plugin-sdk/proto/gen"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var _ component.Status = (*Platform)(nil)
+
+// Implement Status
+func (p *Platform) StatusFunc() interface{} {
+	return p.Status
+}
+
+// Status checks that the deployment's bucket is still set up to serve it and
+// that every object in its manifest is present and unmodified
+func (p *Platform) Status(
+	ctx context.Context,
+	ui terminal.UI,
+	log hclog.Logger,
+	deployment *Deployment,
+) (*sdk.StatusReport, error) {
+	u := ui.Status()
+	defer u.Close()
+	u.Update("Gathering health report for Cloud Storage deployment...")
+
+	if deployment.DryRun {
+		u.Step(terminal.StatusWarn, "Deployment was a dry run, nothing was uploaded")
+		return &sdk.StatusReport{
+			Health:        sdk.StatusReport_UNKNOWN,
+			HealthMessage: "deployment was a dry run",
+			GeneratedTime: timestamppb.Now(),
+		}, nil
+	}
+
+	policy, err := p.retryPolicy(log, ui)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := p.storageClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Google Cloud: %s", err.Error())
+	}
+	defer client.Close()
+
+	report := &sdk.StatusReport{}
+
+	var attrs *storage.BucketAttrs
+	err = policy.Do(ctx, "get bucket", func() (err error) {
+		attrs, err = client.Bucket(deployment.Bucket).Attrs(ctx)
+		return err
+	})
+	if err == storage.ErrBucketNotExist {
+		report.Resources = append(report.Resources, &sdk.StatusReport_Resource{
+			Name:          "bucket",
+			Health:        sdk.StatusReport_DOWN,
+			HealthMessage: fmt.Sprintf("bucket %s does not exist", deployment.Bucket),
+		})
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get bucket: %s", err.Error())
+	} else {
+		report.Resources = append(report.Resources, &sdk.StatusReport_Resource{
+			Name:          "bucket",
+			Health:        sdk.StatusReport_READY,
+			HealthMessage: fmt.Sprintf("bucket %s exists", deployment.Bucket),
+		})
+
+		report.Resources = append(report.Resources, p.websiteStatus(attrs, deployment))
+
+		var public bool
+		err = policy.Do(ctx, "get bucket IAM policy", func() (err error) {
+			public, err = areObjectsPublic(ctx, client, deployment.Bucket)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get bucket IAM policy: %s", err.Error())
+		}
+		report.Resources = append(report.Resources, iamStatus(public, deployment.Private))
+
+		var objects map[string]*storage.ObjectAttrs
+		err = policy.Do(ctx, "list objects", func() (err error) {
+			objects, err = listObjects(ctx, client, deployment.Bucket, deployment.Prefix)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %s", err.Error())
+		}
+		report.Resources = append(report.Resources, p.objectsStatus(ctx, client, deployment, objects))
+	}
+
+	report.Health, report.HealthMessage = overallHealth(report.Resources)
+	report.GeneratedTime = timestamppb.Now()
+
+	switch report.Health {
+	case sdk.StatusReport_READY:
+		u.Step(terminal.StatusOK, report.HealthMessage)
+	case sdk.StatusReport_DOWN:
+		u.Step(terminal.StatusError, report.HealthMessage)
+	default:
+		u.Step(terminal.StatusWarn, report.HealthMessage)
+	}
+
+	return report, nil
+}
+
+// websiteStatus checks the bucket still serves the deployment's index and 404
+// pages
+func (p *Platform) websiteStatus(attrs *storage.BucketAttrs, deployment *Deployment) *sdk.StatusReport_Resource {
+	indexPage := p.config.IndexPage
+	if indexPage == "" {
+		indexPage = "index.html"
+	}
+
+	// versioned deployments share the 404 page with whichever one is released,
+	// so it's only checked when every deployment lives at the bucket root
+	notFoundPage := p.config.NotFoundPage
+	if deployment.Prefix != "" && attrs.Website != nil {
+		notFoundPage = attrs.Website.NotFoundPage
+	}
+
+	resource := &sdk.StatusReport_Resource{Name: "website"}
+
+	switch {
+	case attrs.Website == nil:
+		resource.Health = sdk.StatusReport_DOWN
+		resource.HealthMessage = "bucket has no website configuration"
+	case attrs.Website.MainPageSuffix != indexPage:
+		resource.Health = sdk.StatusReport_DOWN
+		resource.HealthMessage = fmt.Sprintf("index page is %q, expected %q", attrs.Website.MainPageSuffix, indexPage)
+	case attrs.Website.NotFoundPage != notFoundPage:
+		resource.Health = sdk.StatusReport_PARTIAL
+		resource.HealthMessage = fmt.Sprintf("not found page is %q, expected %q", attrs.Website.NotFoundPage, notFoundPage)
+	default:
+		resource.Health = sdk.StatusReport_READY
+		resource.HealthMessage = "website configuration is correct"
+	}
+
+	return resource
+}
+
+func iamStatus(public, private bool) *sdk.StatusReport_Resource {
+	resource := &sdk.StatusReport_Resource{Name: "iam"}
+
+	switch {
+	case !private && !public:
+		resource.Health = sdk.StatusReport_DOWN
+		resource.HealthMessage = "objects are not publicly readable"
+	case private && public:
+		resource.Health = sdk.StatusReport_PARTIAL
+		resource.HealthMessage = "objects are publicly readable although the deployment is private"
+	case private:
+		resource.Health = sdk.StatusReport_READY
+		resource.HealthMessage = "objects are private"
+	default:
+		resource.Health = sdk.StatusReport_READY
+		resource.HealthMessage = "objects are publicly readable"
+	}
+
+	return resource
+}
+
+// objectsStatus loads the deployment's manifest from the bucket and checks it
+// against the objects there
+func (p *Platform) objectsStatus(
+	ctx context.Context,
+	client *storage.Client,
+	deployment *Deployment,
+	objects map[string]*storage.ObjectAttrs,
+) *sdk.StatusReport_Resource {
+	resource := &sdk.StatusReport_Resource{Name: "objects"}
+
+	// deployments from before the manifest was recorded
+	if deployment.ManifestObject == "" {
+		resource.Health = sdk.StatusReport_UNKNOWN
+		resource.HealthMessage = "deployment has no manifest, redeploy to check its objects"
+		return resource
+	}
+
+	manifest, err := readManifest(ctx, client, deployment.Bucket, deployment.ManifestObject)
+	if err != nil {
+		resource.Health = sdk.StatusReport_UNKNOWN
+		resource.HealthMessage = fmt.Sprintf("manifest %s could not be read: %s", deployment.ManifestObject, err.Error())
+		return resource
+	}
+
+	if manifestHash(manifest) != deployment.ManifestHash {
+		resource.Health = sdk.StatusReport_UNKNOWN
+		resource.HealthMessage = fmt.Sprintf("manifest %s was modified since the deployment", deployment.ManifestObject)
+		return resource
+	}
+
+	return manifestStatus(manifest, objects)
+}
+
+// manifestStatus compares the deployment's manifest against what's in the
+// bucket now
+func manifestStatus(manifest map[string]string, objects map[string]*storage.ObjectAttrs) *sdk.StatusReport_Resource {
+	resource := &sdk.StatusReport_Resource{Name: "objects"}
+
+	// nothing was uploaded, such as when every file was excluded
+	if len(manifest) == 0 {
+		resource.Health = sdk.StatusReport_READY
+		resource.HealthMessage = "deployment has no objects"
+		return resource
+	}
+
+	missing, modified := 0, 0
+	for name, md5 := range manifest {
+		attrs, ok := objects[name]
+		if !ok {
+			missing++
+		} else if hex.EncodeToString(attrs.MD5) != md5 {
+			modified++
+		}
+	}
+
+	switch {
+	case missing == len(manifest):
+		resource.Health = sdk.StatusReport_DOWN
+		resource.HealthMessage = fmt.Sprintf("all %d objects are missing", missing)
+	case missing > 0 || modified > 0:
+		resource.Health = sdk.StatusReport_PARTIAL
+		resource.HealthMessage = fmt.Sprintf("%d of %d objects are missing and %d were modified", missing, len(manifest), modified)
+	default:
+		resource.Health = sdk.StatusReport_READY
+		resource.HealthMessage = fmt.Sprintf("all %d objects are present and unmodified", len(manifest))
+	}
+
+	return resource
+}
+
+// overallHealth is READY when every checked resource is, DOWN when none of
+// them are and PARTIAL in between
+func overallHealth(resources []*sdk.StatusReport_Resource) (sdk.StatusReport_Health, string) {
+	checked, ready, down := 0, 0, 0
+	problems := []string{}
+
+	for _, r := range resources {
+		switch r.Health {
+		case sdk.StatusReport_UNKNOWN:
+			continue
+		case sdk.StatusReport_READY:
+			ready++
+		case sdk.StatusReport_DOWN:
+			down++
+			problems = append(problems, r.Name+": "+r.HealthMessage)
+		default:
+			problems = append(problems, r.Name+": "+r.HealthMessage)
+		}
+		checked++
+	}
+
+	switch {
+	case checked == 0:
+		return sdk.StatusReport_UNKNOWN, "no resources could be checked"
+	case ready == checked:
+		return sdk.StatusReport_READY, "All Cloud Storage resources are healthy"
+	case down == checked:
+		return sdk.StatusReport_DOWN, "Deployment is down: " + strings.Join(problems, "; ")
+	default:
+		return sdk.StatusReport_PARTIAL, "Deployment is degraded: " + strings.Join(problems, "; ")
+	}
+}
@@ -0,0 +1,436 @@
+package platform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/retry"
+	"google.golang.org/api/iterator"
+)
+
+// number of files uploaded at once when concurrency isn't configured
+const defaultConcurrency = 16
+
+// files smaller than this aren't worth compressing when gzip_min_size isn't configured
+const defaultGzipMinSize = 1024
+
+// compressible text assets gzipped when gzip_extensions isn't configured
+var defaultGzipExtensions = []string{".html", ".css", ".js", ".mjs", ".json", ".map", ".svg", ".xml", ".txt"}
+
+// listObjects returns the attributes of every object in the bucket under prefix,
+// keyed by object name
+func listObjects(
+	c context.Context,
+	client *storage.Client,
+	bucketName string,
+	prefix string,
+) (map[string]*storage.ObjectAttrs, error) {
+	objects := map[string]*storage.ObjectAttrs{}
+
+	it := client.Bucket(bucketName).Objects(c, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		objects[attrs.Name] = attrs
+	}
+
+	return objects, nil
+}
+
+// computes the same MD5 and CRC32C checksums that Cloud Storage records for an object
+func fileChecksums(r io.Reader) ([]byte, uint32, error) {
+	md5Hash := md5.New()
+	crcHash := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.Copy(io.MultiWriter(md5Hash, crcHash), r); err != nil {
+		return nil, 0, err
+	}
+
+	return md5Hash.Sum(nil), crcHash.Sum32(), nil
+}
+
+// composite objects have no MD5, so fall back to CRC32C when it is missing
+func isUnchanged(attrs *storage.ObjectAttrs, md5Sum []byte, crc uint32) bool {
+	if attrs == nil {
+		return false
+	}
+
+	if len(attrs.MD5) > 0 {
+		return bytes.Equal(attrs.MD5, md5Sum)
+	}
+
+	return attrs.CRC32C == crc
+}
+
+// a file in the build directory and the object name it is uploaded as
+type localFile struct {
+	Name string
+	Path string
+	Size int64
+}
+
+// collectFiles walks the build directory and returns every regular file in it
+// that filter allows, along with the number of files it skipped
+func collectFiles(buildDir string, filter *fileFilter) ([]localFile, int, error) {
+	files := []localFile{}
+	skipped := 0
+
+	err := filepath.WalkDir(buildDir, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(buildDir, fpath)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if filter != nil && !filter.Allows(name) {
+			skipped++
+			return nil
+		}
+
+		files = append(files, localFile{
+			Name: name,
+			Path: fpath,
+			Size: info.Size(),
+		})
+
+		return nil
+	})
+
+	return files, skipped, err
+}
+
+type uploadStats struct {
+	Uploaded   int
+	Unchanged  int
+	Compressed int
+	BytesSaved int64
+	TotalBytes int64
+}
+
+// uploader writes local files to a bucket using a bounded pool of workers
+type uploader struct {
+	client      *storage.Client
+	retry       *retry.Policy
+	bucket      string
+	prefix      string
+	concurrency int
+	existing    map[string]*storage.ObjectAttrs
+
+	// extension to content type overrides, keys normalized with a leading dot
+	contentTypes map[string]string
+
+	// compiled metadata rules applied to every object in order
+	metadataRules []*MetadataRule
+
+	// gzip files with these extensions that are at least gzipMinSize bytes
+	gzip           bool
+	gzipMinSize    int64
+	gzipExtensions map[string]bool
+
+	// Cloud KMS key every object is encrypted with
+	kmsKey string
+	// how to grant access to kmsKey, added to failures it causes
+	kmsHint string
+
+	// work out what would be uploaded without writing anything
+	dryRun bool
+
+	mu     sync.Mutex
+	stats  uploadStats
+	errors []*FailedFile
+
+	// object name to hex MD5 of every file that made it into the bucket
+	manifest map[string]string
+
+	// every object that was, or in a dry run would be, written
+	changes []plannedChange
+}
+
+// how an object differs from the local file it is uploaded from
+const (
+	actionCreate    = "create"
+	actionUpdate    = "update"
+	actionDelete    = "delete"
+	actionUnchanged = "unchanged"
+)
+
+type plannedChange struct {
+	Name   string
+	Action string
+	Size   int64
+}
+
+// the outcome of handling a single file
+type uploadResult struct {
+	ObjectName string
+	MD5        []byte
+	Size       int64
+	Action     string
+	Compressed bool
+	BytesSaved int64
+}
+
+// Run uploads every file that differs from its existing object and returns the
+// upload counts along with any per-file errors. It stops handing out files as
+// soon as ctx is cancelled.
+func (up *uploader) Run(ctx context.Context, files []localFile) (uploadStats, []*FailedFile) {
+	up.manifest = make(map[string]string, len(files))
+
+	jobs := make(chan localFile)
+
+	var wg sync.WaitGroup
+	for i := 0; i < up.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				var result uploadResult
+				err := up.retry.Do(ctx, "upload "+file.Name, func() (err error) {
+					result, err = up.upload(ctx, file)
+					return err
+				})
+				up.record(file, result, err)
+			}
+		}()
+	}
+
+feed:
+	for _, file := range files {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- file:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return up.stats, up.errors
+}
+
+func (up *uploader) record(file localFile, result uploadResult, err error) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	if err != nil {
+		up.errors = append(up.errors, &FailedFile{Path: file.Name, Reason: explainKMSError(err, up.kmsHint)})
+		return
+	}
+
+	if result.Action == actionUnchanged {
+		up.stats.Unchanged++
+	} else {
+		up.stats.Uploaded++
+		up.changes = append(up.changes, plannedChange{
+			Name:   result.ObjectName,
+			Action: result.Action,
+			Size:   result.Size,
+		})
+	}
+
+	up.stats.TotalBytes += result.Size
+	up.manifest[result.ObjectName] = hex.EncodeToString(result.MD5)
+
+	if result.Compressed {
+		up.stats.Compressed++
+		up.stats.BytesSaved += result.BytesSaved
+	}
+}
+
+func (up *uploader) shouldCompress(file localFile) bool {
+	return up.gzip &&
+		file.Size >= up.gzipMinSize &&
+		up.gzipExtensions[strings.ToLower(path.Ext(file.Name))]
+}
+
+// formatBytes renders n using the largest binary unit that keeps it above one
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// manifestHash fingerprints a deployment's content from its sorted object names
+// and checksums
+func manifestHash(manifest map[string]string) string {
+	names := make([]string, 0, len(manifest))
+	for name := range manifest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s %s\n", name, manifest[name])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// gzipFile compresses r into memory. The output is deterministic for the same
+// input, so checksums of unchanged files still match their existing objects.
+func gzipFile(r io.Reader) (*bytes.Reader, error) {
+	var buf bytes.Buffer
+
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(zw, r); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(buf.Bytes()), nil
+}
+
+// upload streams a single file to its object, skipping it if the object already
+// holds the same content and headers. The file is closed before returning.
+func (up *uploader) upload(ctx context.Context, file localFile) (uploadResult, error) {
+	result := uploadResult{}
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+
+	cType, err := detectMimeType(file.Name, f, up.contentTypes)
+	if err != nil {
+		return result, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+
+	headers := objectHeaders{ContentType: cType}
+	applyMetadataRules(&headers, file.Name, up.metadataRules)
+
+	var body io.ReadSeeker = f
+
+	if up.shouldCompress(file) {
+		compressed, err := gzipFile(f)
+		if err != nil {
+			return result, err
+		}
+
+		// Cloud Storage transcodes gzip objects back for clients that don't
+		// accept it, so only keep the compressed copy when it is smaller
+		if compressed.Size() < file.Size {
+			body = compressed
+			headers.ContentEncoding = "gzip"
+			result.Compressed = true
+			result.BytesSaved = file.Size - compressed.Size()
+		} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return result, err
+		}
+	}
+
+	md5Sum, crc, err := fileChecksums(body)
+	if err != nil {
+		return result, err
+	}
+
+	size, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return result, err
+	}
+
+	// re-upload when only the headers changed so the object is rewritten with
+	// the new cache and metadata settings
+	objectName := up.prefix + file.Name
+
+	result.ObjectName = objectName
+	result.MD5 = md5Sum
+	result.Size = size
+
+	existing := up.existing[objectName]
+	if existing == nil {
+		result.Action = actionCreate
+	} else if isUnchanged(existing, md5Sum, crc) && headersMatch(existing, headers) &&
+		(up.kmsKey == "" || encryptedWith(existing, up.kmsKey)) {
+		result.Action = actionUnchanged
+		return result, nil
+	} else {
+		result.Action = actionUpdate
+	}
+
+	if up.dryRun {
+		return result, nil
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+
+	obj := up.client.Bucket(up.bucket).Object(objectName)
+
+	// cancelling the writer's context aborts the upload instead of committing
+	// a partially written object
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wc := obj.NewWriter(wctx)
+	headers.apply(wc)
+	wc.KMSKeyName = up.kmsKey
+	if _, err = io.Copy(wc, body); err != nil {
+		return result, err
+	}
+
+	if err := wc.Close(); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
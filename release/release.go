@@ -2,12 +2,19 @@ package release
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
+	"os"
+	"strings"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/waypoint-plugin-sdk/component"
 	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
 	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/gcloud"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/ownership"
 	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/platform"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/retry"
 )
 
 func (r *Release) URL() string { return r.Url }
@@ -16,6 +23,22 @@ var _ component.Release = (*Release)(nil)
 
 type ReleaseConfig struct {
 	Domain string `hcl:"domain"`
+
+	// key Cloud CDN signs requests to a private bucket with, generated when unset
+	SignedURLKeyFile string `hcl:"signed_url_key_file,optional"`
+
+	// identity gcloud runs as, matching the platform's settings of the same
+	// name. When none are set the platform's are used, so both phases run as
+	// the same account.
+	CredentialsFile           string `hcl:"credentials_file,optional"`
+	ImpersonateServiceAccount string `hcl:"impersonate_service_account,optional"`
+	GCloudAccount             string `hcl:"gcloud_account,optional"`
+
+	// destroy resources even when they lack this app's ownership description
+	Force bool `hcl:"force,optional"`
+
+	// backoff for transient gcloud failures such as resources that aren't ready
+	Retry *retry.Config `hcl:"retry,block"`
 }
 
 type ReleaseManager struct {
@@ -29,12 +52,41 @@ func (rm *ReleaseManager) DestroyFunc() interface{} {
 
 // If an error is returned, Waypoint stops the execution flow and
 // returns an error to the user.
-func (rm *ReleaseManager) Destroy(ctx context.Context, ui terminal.UI, release *Release) error {
+func (rm *ReleaseManager) Destroy(
+	ctx context.Context,
+	ui terminal.UI,
+	log hclog.Logger,
+	src *component.Source,
+	job *component.JobInfo,
+	release *Release,
+) error {
 	u := ui.Status()
 	defer u.Close()
 	u.Step("", "---Destroying Cloud CDN resources---")
 
-	gc := gcloud.Init(release.Project, release.Bucket)
+	owner := ownership.For(src, job, release.Project)
+
+	id := rm.identity(identity{release.CredentialsFile, release.ImpersonateServiceAccount, release.GcloudAccount})
+
+	gc, err := rm.gcloud(ctx, ui, log, owner, id, release.Project, release.Bucket)
+	if err != nil {
+		return err
+	}
+
+	// CHECK OWNERSHIP
+	// resources are found by name, so make sure every one of them is ours
+	// before deleting anything
+	u.Update("Checking ownership of Cloud CDN resources...")
+
+	foreign := unownedResources(gc, owner)
+	if len(foreign) > 0 {
+		if !rm.config.Force {
+			u.Step(terminal.StatusError, fmt.Sprintf("Not owned by this app: %s", strings.Join(foreign, ", ")))
+			return ownership.Refusal(strings.Join(foreign, ", "))
+		}
+
+		u.Step(terminal.StatusWarn, fmt.Sprintf("Not owned by this app, destroying anyway: %s", strings.Join(foreign, ", ")))
+	}
 
 	// DESTROY FORWARDING RULE
 	u.Update("Destroying forwarding rule...")
@@ -129,6 +181,14 @@ func (rm *ReleaseManager) ConfigSet(config interface{}) error {
 		return fmt.Errorf("domain is a required attribute")
 	}
 
+	if _, err := rm.config.Retry.Policy(); err != nil {
+		return err
+	}
+
+	if err := platform.ValidateImpersonation(rm.config.ImpersonateServiceAccount); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -138,7 +198,110 @@ func (rm *ReleaseManager) ReleaseFunc() interface{} {
 	return rm.Release
 }
 
-func (rm *ReleaseManager) Release(ctx context.Context, ui terminal.UI, target *platform.Deployment) (*Release, error) {
+// unownedResources lists the existing resources that weren't created for owner
+func unownedResources(gc *gcloud.GCloud, owner ownership.Owner) []string {
+	type resource struct {
+		name        string
+		exists      func() bool
+		description func() (string, error)
+	}
+
+	resources := []resource{
+		{"forwarding rule", gc.ForwardRule.Exists, gc.ForwardRule.GetDescription},
+		{"HTTPS proxy",
+			func() bool { return gc.Proxy.Exists("https") },
+			func() (string, error) { return gc.Proxy.GetDescription("https") }},
+		{"SSL Certificate", gc.SSLCert.Exists, gc.SSLCert.GetDescription},
+		{"load balancer", gc.URLMap.Exists, gc.URLMap.GetDescription},
+		{"backend bucket", gc.BackendBucket.Exists, gc.BackendBucket.GetDescription},
+		{"IP address", gc.IP.Exists, gc.IP.GetDescription},
+	}
+
+	foreign := []string{}
+	for _, r := range resources {
+		if !r.exists() {
+			continue
+		}
+
+		description, err := r.description()
+		if err != nil || !owner.OwnsDescription(description) {
+			foreign = append(foreign, r.name)
+		}
+	}
+
+	return foreign
+}
+
+// gcloud returns a client for the release's resources which retries transient
+// failures according to the configured policy, logging every retry, and
+// stamps owner on every resource it creates
+// identity gcloud runs as
+type identity struct {
+	CredentialsFile           string
+	ImpersonateServiceAccount string
+	GCloudAccount             string
+}
+
+// identity is the release's own settings when any are set, otherwise the one
+// recorded by the phase before
+func (rm *ReleaseManager) identity(recorded identity) identity {
+	own := identity{rm.config.CredentialsFile, rm.config.ImpersonateServiceAccount, rm.config.GCloudAccount}
+	if own != (identity{}) {
+		return own
+	}
+
+	return recorded
+}
+
+func (rm *ReleaseManager) gcloud(ctx context.Context, ui terminal.UI, log hclog.Logger, owner ownership.Owner, id identity, project, bucket string) (*gcloud.GCloud, error) {
+	policy, err := rm.config.Retry.Policy()
+	if err != nil {
+		return nil, err
+	}
+
+	policy.Notify = retry.Notifier(log, ui)
+
+	gc := gcloud.Init(project, bucket)
+	gc.Retry = policy
+	gc.Context = ctx
+	gc.Description = owner.Description()
+	gc.Account = id.GCloudAccount
+	gc.ImpersonateServiceAccount = id.ImpersonateServiceAccount
+	gc.CredentialsFile = id.CredentialsFile
+
+	return gc, nil
+}
+
+// generateKeyFile writes a random 128-bit signing key, base64url encoded as
+// Cloud CDN expects, to a temporary file
+func generateKeyFile() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp("", "cdn-key-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(base64.URLEncoding.EncodeToString(key)); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func (rm *ReleaseManager) Release(
+	ctx context.Context,
+	ui terminal.UI,
+	log hclog.Logger,
+	src *component.Source,
+	job *component.JobInfo,
+	target *platform.Deployment,
+) (*Release, error) {
 	u := ui.Status()
 	defer u.Close()
 
@@ -149,7 +312,19 @@ func (rm *ReleaseManager) Release(ctx context.Context, ui terminal.UI, target *p
 
 	u.Step("", "---Releasing to Cloud CDN---")
 
-	gc := gcloud.Init(target.Project, target.Bucket)
+	// releasing a dry run would record it as the live deployment, leaving the
+	// one actually being served to be pruned
+	if target.DryRun {
+		u.Step(terminal.StatusError, "Deployment was a dry run, nothing was uploaded")
+		return nil, fmt.Errorf("refusing to release a dry run deployment, use waypoint deploy rather than waypoint up to plan changes")
+	}
+
+	id := rm.identity(identity{target.CredentialsFile, target.ImpersonateServiceAccount, target.GcloudAccount})
+
+	gc, err := rm.gcloud(ctx, ui, log, ownership.For(src, job, target.Project), id, target.Project, target.Bucket)
+	if err != nil {
+		return nil, err
+	}
 
 	// PROVISION IP ADDRESS
 	u.Update("Configuring IP Address...")
@@ -181,6 +356,35 @@ func (rm *ReleaseManager) Release(ctx context.Context, ui terminal.UI, target *p
 		u.Step(terminal.StatusOK, "Created new backend bucket")
 	}
 
+	// GRANT CLOUD CDN ACCESS TO PRIVATE BUCKET
+	if target.Private {
+		u.Update("Configuring signed requests to private bucket...")
+
+		if !gc.BackendBucket.HasSignedURLKey() {
+			keyFile := rm.config.SignedURLKeyFile
+			if keyFile == "" {
+				generated, err := generateKeyFile()
+				if err != nil {
+					return nil, fmt.Errorf("failed to generate signed request key: %s", err.Error())
+				}
+				defer os.Remove(generated)
+				keyFile = generated
+			}
+
+			_, err := gc.BackendBucket.AddSignedURLKey(keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to add signed request key to backend bucket: %s", err.Error())
+			}
+		}
+
+		_, err := gc.StorageBucket.GrantCDNFill()
+		if err != nil {
+			return nil, fmt.Errorf("failed to grant Cloud CDN read access to bucket: %s", err.Error())
+		}
+
+		u.Step(terminal.StatusOK, "Granted Cloud CDN read access to private bucket")
+	}
+
 	// PROVISION LOAD BALANCER
 	u.Update("Configuring load balancer...")
 
@@ -196,6 +400,44 @@ func (rm *ReleaseManager) Release(ctx context.Context, ui terminal.UI, target *p
 		u.Step(terminal.StatusOK, "Created new load balancer")
 	}
 
+	// SWITCH TO VERSIONED DEPLOYMENT
+	if target.Prefix != "" {
+		u.Update(fmt.Sprintf("Routing load balancer to %s...", target.Prefix))
+
+		_, err := gc.URLMap.Route(target.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to route load balancer to deployment: %s", err.Error())
+		}
+
+		u.Step(terminal.StatusOK, fmt.Sprintf("Load balancer now serving %s", target.Prefix))
+
+		// the bucket resolves 404s itself, so its error page moves with the traffic
+		if target.NotFoundPage != "" {
+			_, err := gc.StorageBucket.SetNotFoundPage(target.NotFoundPage)
+			if err != nil {
+				return nil, fmt.Errorf("failed to point bucket 404 page at deployment: %s", err.Error())
+			}
+		}
+	} else {
+		// a versioned release left a rewrite behind, which would keep serving
+		// the old deployment now that versioning is off
+		routed, err := gc.URLMap.IsRouted()
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect load balancer routes: %s", err.Error())
+		}
+
+		if routed {
+			u.Update("Routing load balancer to the bucket root...")
+
+			_, err := gc.URLMap.Unroute()
+			if err != nil {
+				return nil, fmt.Errorf("failed to route load balancer to the bucket root: %s", err.Error())
+			}
+
+			u.Step(terminal.StatusOK, "Load balancer now serving the bucket root")
+		}
+	}
+
 	// GENERATE SSL CERTIFICATE
 	u.Update("Configuring SSL Certificate...")
 
@@ -241,11 +483,16 @@ func (rm *ReleaseManager) Release(ctx context.Context, ui terminal.UI, target *p
 		u.Step(terminal.StatusOK, "Created new forwarding rule")
 	}
 
-	u.Step("", "Please allow at least 30 minutes for SSL certificate to be fully provisioned - don't forget to set up your DNS too!")
+	u.Step("", "Please allow at least 30 minutes for SSL certificate to be fully provisioned - don't forget to set up your DNS too! Run waypoint status to follow its progress")
 
 	return &Release{
 		Url:     "https://" + rm.config.Domain,
 		Project: target.Project,
 		Bucket:  target.Bucket,
+		Prefix:  target.Prefix,
+
+		CredentialsFile:           id.CredentialsFile,
+		ImpersonateServiceAccount: id.ImpersonateServiceAccount,
+		GcloudAccount:             id.GCloudAccount,
 	}, nil
 }
@@ -0,0 +1,222 @@
+package release
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/waypoint-plugin-sdk/component"
+	sdk "github.com/hashicorp/waypoint-plugin-sdk/proto/gen"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/gcloud"
+	"github.com/pilot-framework/gcp-cdn-waypoint-plugin/ownership"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var _ component.Status = (*ReleaseManager)(nil)
+
+// Implement Status
+func (rm *ReleaseManager) StatusFunc() interface{} {
+	return rm.Status
+}
+
+// explanations for the per domain states of a managed certificate
+var domainStatusMessages = map[string]string{
+	"ACTIVE":                    "certificate is active",
+	"PROVISIONING":              "certificate is being provisioned, which can take up to an hour once DNS points at %s",
+	"FAILED_NOT_VISIBLE":        "DNS for the domain doesn't resolve to %s yet, add an A record pointing at it",
+	"FAILED_CAA_CHECKING":       "the domain's CAA records couldn't be checked, provisioning will be retried",
+	"FAILED_CAA_FORBIDDEN":      "the domain's CAA records don't allow pki.goog to issue certificates",
+	"FAILED_RATE_LIMITED":       "the certificate authority's rate limit was reached, provisioning will be retried",
+	"DOMAIN_STATUS_UNSPECIFIED": "certificate status is unknown",
+}
+
+// Status checks every load balancer resource and the managed certificate's
+// state for each domain
+func (rm *ReleaseManager) Status(
+	ctx context.Context,
+	ui terminal.UI,
+	log hclog.Logger,
+	release *Release,
+) (*sdk.StatusReport, error) {
+	u := ui.Status()
+	defer u.Close()
+	u.Update("Gathering health report for Cloud CDN release...")
+
+	// nothing is created here, so the owner doesn't matter
+	id := rm.identity(identity{release.CredentialsFile, release.ImpersonateServiceAccount, release.GcloudAccount})
+
+	gc, err := rm.gcloud(ctx, ui, log, ownership.Owner{}, id, release.Project, release.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &sdk.StatusReport{}
+
+	address, ipResource := ipStatus(gc)
+	report.Resources = append(report.Resources, ipResource)
+
+	report.Resources = append(report.Resources,
+		existsStatus("backend bucket", gc.BackendBucket.Exists()),
+		existsStatus("load balancer", gc.URLMap.Exists()),
+		existsStatus("HTTPS proxy", gc.Proxy.Exists("https")),
+		existsStatus("forwarding rule", gc.ForwardRule.Exists()),
+	)
+
+	report.Resources = append(report.Resources, certStatus(gc, address)...)
+
+	report.Health, report.HealthMessage = releaseHealth(report.Resources)
+	report.GeneratedTime = timestamppb.Now()
+
+	switch report.Health {
+	case sdk.StatusReport_READY:
+		u.Step(terminal.StatusOK, report.HealthMessage)
+	case sdk.StatusReport_DOWN:
+		u.Step(terminal.StatusError, report.HealthMessage)
+	default:
+		u.Step(terminal.StatusWarn, report.HealthMessage)
+	}
+
+	return report, nil
+}
+
+func existsStatus(name string, exists bool) *sdk.StatusReport_Resource {
+	if !exists {
+		return &sdk.StatusReport_Resource{
+			Name:          name,
+			Health:        sdk.StatusReport_DOWN,
+			HealthMessage: name + " does not exist, run the release again to recreate it",
+		}
+	}
+
+	return &sdk.StatusReport_Resource{
+		Name:          name,
+		Health:        sdk.StatusReport_READY,
+		HealthMessage: name + " exists",
+	}
+}
+
+func ipStatus(gc *gcloud.GCloud) (string, *sdk.StatusReport_Resource) {
+	resource := &sdk.StatusReport_Resource{Name: "IP address"}
+
+	address, status, err := gc.IP.Address()
+	switch {
+	case err != nil:
+		resource.Health = sdk.StatusReport_DOWN
+		resource.HealthMessage = "IP address is not reserved, run the release again to reserve it"
+	case status != "IN_USE":
+		resource.Health = sdk.StatusReport_DOWN
+		resource.HealthMessage = fmt.Sprintf("%s is reserved but no forwarding rule uses it", address)
+	default:
+		resource.Health = sdk.StatusReport_READY
+		resource.HealthMessage = fmt.Sprintf("%s is in use", address)
+	}
+
+	return address, resource
+}
+
+// certStatus reports the managed certificate as a whole and each of its domains
+func certStatus(gc *gcloud.GCloud, address string) []*sdk.StatusReport_Resource {
+	if address == "" {
+		address = "the load balancer's IP address"
+	}
+
+	managed, err := gc.SSLCert.ManagedStatus()
+	if err != nil {
+		return []*sdk.StatusReport_Resource{{
+			Name:          "SSL Certificate",
+			Health:        sdk.StatusReport_DOWN,
+			HealthMessage: fmt.Sprintf("certificate could not be found: %s", err.Error()),
+		}}
+	}
+
+	domains := make([]string, 0, len(managed.DomainStatus))
+	for domain := range managed.DomainStatus {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	resources := []*sdk.StatusReport_Resource{}
+	for _, domain := range domains {
+		status := managed.DomainStatus[domain]
+
+		message, ok := domainStatusMessages[status]
+		if !ok {
+			message = "certificate status is " + status
+		}
+		if strings.Contains(message, "%s") {
+			message = fmt.Sprintf(message, address)
+		}
+
+		resource := &sdk.StatusReport_Resource{
+			Name:          "SSL Certificate " + domain,
+			HealthMessage: fmt.Sprintf("%s: %s", status, message),
+		}
+
+		switch {
+		case status == "ACTIVE":
+			resource.Health = sdk.StatusReport_READY
+		case status == "PROVISIONING":
+			resource.Health = sdk.StatusReport_ALIVE
+		default:
+			resource.Health = sdk.StatusReport_DOWN
+		}
+
+		resources = append(resources, resource)
+	}
+
+	// a failed certificate never recovers on its own and has to be recreated
+	if managed.Status == "PROVISIONING_FAILED" || managed.Status == "PROVISIONING_FAILED_PERMANENTLY" {
+		resources = append(resources, &sdk.StatusReport_Resource{
+			Name:          "SSL Certificate",
+			Health:        sdk.StatusReport_DOWN,
+			HealthMessage: managed.Status + ": fix the domain problems above, then destroy and release again to recreate the certificate",
+		})
+	}
+
+	return resources
+}
+
+// releaseHealth is READY when everything is, ALIVE while the certificate is
+// still provisioning, DOWN when nothing can be served and PARTIAL otherwise
+func releaseHealth(resources []*sdk.StatusReport_Resource) (sdk.StatusReport_Health, string) {
+	ready, alive, certsDown := 0, 0, 0
+	certs := 0
+	problems := []string{}
+
+	for _, r := range resources {
+		isCert := strings.HasPrefix(r.Name, "SSL Certificate")
+		if isCert {
+			certs++
+		}
+
+		switch r.Health {
+		case sdk.StatusReport_READY:
+			ready++
+			continue
+		case sdk.StatusReport_ALIVE:
+			alive++
+		case sdk.StatusReport_DOWN:
+			// without the load balancer nothing is served, whatever the certificate says
+			if !isCert {
+				return sdk.StatusReport_DOWN, fmt.Sprintf("Release is down: %s: %s", r.Name, r.HealthMessage)
+			}
+			certsDown++
+		}
+
+		problems = append(problems, r.Name+": "+r.HealthMessage)
+	}
+
+	switch {
+	case ready == len(resources):
+		return sdk.StatusReport_READY, "All Cloud CDN resources are healthy"
+	case certsDown == certs:
+		return sdk.StatusReport_DOWN, "Release is down, HTTPS can't be served: " + strings.Join(problems, "; ")
+	case alive > 0 && certsDown == 0:
+		return sdk.StatusReport_ALIVE, "Release is waiting on the SSL Certificate: " + strings.Join(problems, "; ")
+	default:
+		return sdk.StatusReport_PARTIAL, "Release is degraded: " + strings.Join(problems, "; ")
+	}
+}
@@ -0,0 +1,193 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultAttempts       = 5
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// Config is the retry block shared by the platform and release configs:
+//
+//	retry {
+//	  attempts        = 5
+//	  initial_backoff = "1s"
+//	  max_backoff     = "30s"
+//	}
+type Config struct {
+	Attempts       int    `hcl:"attempts,optional"`
+	InitialBackoff string `hcl:"initial_backoff,optional"`
+	MaxBackoff     string `hcl:"max_backoff,optional"`
+}
+
+// Policy retries transient failures with exponential backoff and jitter
+type Policy struct {
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Notify is called before waiting to retry a failed operation
+	Notify func(op string, attempt int, wait time.Duration, err error)
+}
+
+// Policy builds a retry policy from c, filling in defaults for anything unset.
+// A nil Config gives the default policy.
+func (c *Config) Policy() (*Policy, error) {
+	p := &Policy{
+		Attempts:       defaultAttempts,
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+	}
+
+	if c == nil {
+		return p, nil
+	}
+
+	if c.Attempts < 0 {
+		return nil, fmt.Errorf("retry attempts must not be negative")
+	}
+	if c.Attempts > 0 {
+		p.Attempts = c.Attempts
+	}
+
+	if c.InitialBackoff != "" {
+		d, err := time.ParseDuration(c.InitialBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry initial_backoff: %s", err.Error())
+		}
+		p.InitialBackoff = d
+	}
+
+	if c.MaxBackoff != "" {
+		d, err := time.ParseDuration(c.MaxBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry max_backoff: %s", err.Error())
+		}
+		p.MaxBackoff = d
+	}
+
+	if p.MaxBackoff < p.InitialBackoff {
+		return nil, fmt.Errorf("retry max_backoff must not be less than initial_backoff")
+	}
+
+	return p, nil
+}
+
+// Notifier returns a Notify func that reports each retry in the terminal, as
+// the CLI hides log output unless run with -v, and warns about it on log
+func Notifier(log hclog.Logger, ui terminal.UI) func(op string, attempt int, wait time.Duration, err error) {
+	return func(op string, attempt int, wait time.Duration, err error) {
+		log.Warn("retrying after transient error",
+			"operation", op, "attempt", attempt, "wait", wait, "error", err)
+
+		if ui != nil {
+			ui.Output("Retrying %s in %s after attempt %d failed: %s",
+				op, wait.Round(time.Millisecond), attempt, err.Error(), terminal.WithWarningStyle())
+		}
+	}
+}
+
+// Do calls fn until it succeeds, returns an error that isn't retryable, ctx is
+// cancelled, or the policy runs out of attempts. A nil Policy calls fn once.
+func (p *Policy) Do(ctx context.Context, op string, fn func() error) error {
+	if p == nil {
+		return fn()
+	}
+
+	wait := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.Attempts || !IsRetryable(err) {
+			return err
+		}
+
+		// equal jitter, half the wait fixed and half random, keeps concurrent
+		// uploads from retrying in lockstep
+		sleep := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+
+		if p.Notify != nil {
+			p.Notify(op, attempt, sleep, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(sleep):
+		}
+
+		wait *= 2
+		if wait > p.MaxBackoff {
+			wait = p.MaxBackoff
+		}
+	}
+}
+
+// messages gcloud prints for failures that go away on their own. Status codes
+// are matched in the forms gcloud reports them so that a 503 in a resource name
+// or URL isn't mistaken for one.
+var transientMessages = []string{
+	"is not ready",
+	"resourceNotReady",
+	"rateLimitExceeded",
+	"Rate Limit Exceeded",
+	"backendError",
+	"try again",
+	"HTTPError 429",
+	"HTTPError 500",
+	"HTTPError 502",
+	"HTTPError 503",
+	"HTTPError 504",
+	"code=429",
+	"code=500",
+	"code=502",
+	"code=503",
+	"code=504",
+}
+
+// IsRetryable reports whether err is a transient Cloud Storage or gcloud failure
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case 408, 429, 500, 502, 503, 504:
+			return true
+		}
+		return false
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	msg := err.Error()
+	for _, transient := range transientMessages {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,81 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		desc      string
+		err       error
+		retryable bool
+	}{
+		{"nil", nil, false},
+		{"googleapi 429", &googleapi.Error{Code: 429}, true},
+		{"googleapi 500", &googleapi.Error{Code: 500}, true},
+		{"googleapi 503", &googleapi.Error{Code: 503}, true},
+		{"wrapped googleapi 502", fmt.Errorf("upload: %w", &googleapi.Error{Code: 502}), true},
+		{"googleapi 403", &googleapi.Error{Code: 403}, false},
+		{"googleapi 404", &googleapi.Error{Code: 404}, false},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"gcloud HTTPError 503", errors.New("ERROR: (gcloud.storage.buckets.update) HTTPError 503: Service Unavailable"), true},
+		{"gcloud code=429", errors.New("ERROR: (gcloud.compute.url-maps.import) ResponseError: code=429, message=Quota exceeded"), true},
+		{"gcloud not ready", errors.New("ERROR: (gcloud.compute.target-https-proxies.create) The resource 'projects/p/global/urlMaps/site-lb' is not ready"), true},
+		{"503 in resource name", errors.New("ERROR: (gcloud.compute.backend-buckets.describe) The resource 'projects/p/global/backendBuckets/site-503-backend-bucket' was not found"), false},
+		{"429 in address", errors.New("ERROR: (gcloud.compute.addresses.create) Invalid value for field 'address': '34.120.4.29'"), false},
+		{"gcloud HTTPError 403", errors.New("ERROR: (gcloud.storage.buckets.update) HTTPError 403: Forbidden"), false},
+		{"context cancelled", context.Canceled, false},
+		{"wrapped deadline exceeded", fmt.Errorf("upload: %w", context.DeadlineExceeded), false},
+	}
+
+	for _, c := range cases {
+		if got := IsRetryable(c.err); got != c.retryable {
+			t.Errorf("%s: IsRetryable(%v) = %t, want %t", c.desc, c.err, got, c.retryable)
+		}
+	}
+}
+
+func TestDoStopsWhenCancelled(t *testing.T) {
+	p := &Policy{Attempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	err := p.Do(ctx, "op", func() error {
+		calls++
+		return &googleapi.Error{Code: 503}
+	})
+
+	if err == nil || calls != 1 {
+		t.Errorf("Do with a cancelled context made %d calls and returned %v, want 1 call and the error", calls, err)
+	}
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	p := &Policy{Attempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	calls, notified := 0, 0
+	p.Notify = func(op string, attempt int, wait time.Duration, err error) {
+		notified++
+	}
+
+	err := p.Do(context.Background(), "op", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("HTTPError 503: Service Unavailable")
+		}
+		return nil
+	})
+
+	if err != nil || calls != 3 || notified != 2 {
+		t.Errorf("Do made %d calls with %d notifications and returned %v, want 3 calls, 2 notifications and nil", calls, notified, err)
+	}
+}